@@ -6,6 +6,8 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -22,6 +24,8 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 
 func Backend() *backend {
 	var b backend
+	b.roleCache = make(map[string]*cachedChefRole)
+	b.endpointDown = make(map[string]time.Time)
 	b.Backend = &framework.Backend{
 		Help:        backendHelp,
 		BackendType: logical.TypeCredential,
@@ -31,20 +35,74 @@ func Backend() *backend {
 			},
 		},
 
-		Paths: append([]*framework.Path{
+		Paths: []*framework.Path{
 			pathLogin(&b),
 			pathConfig(&b),
 			pathClients(&b),
 			pathClientsList(&b),
-		}),
+			pathClientVersions(&b),
+			pathClientRollback(&b),
+			pathClientTokens(&b),
+			pathClientToken(&b),
+			pathClientPatterns(&b),
+			pathClientPatternsList(&b),
+			pathEnvironments(&b),
+			pathEnvironmentsList(&b),
+			pathChefRoles(&b),
+			pathChefRolesList(&b),
+			pathFreezeGlobal(&b),
+			pathFreezes(&b),
+			pathFreezesList(&b),
+			pathQuarantines(&b),
+			pathQuarantinesList(&b),
+			pathPending(&b),
+			pathPendingList(&b),
+			pathTidy(&b),
+			pathTidyStatus(&b),
+			pathExplain(&b),
+			pathExport(&b),
+			pathImport(&b),
+			pathServers(&b),
+			pathServersList(&b),
+			pathRoles(&b),
+			pathRolesList(&b),
+		},
 
-		AuthRenew: b.pathLoginRenew,
+		AuthRenew:    b.pathLoginRenew,
+		PeriodicFunc: b.periodicFunc,
 	}
 	return &b
 }
 
 type backend struct {
 	*framework.Backend
+
+	roleCacheLock sync.RWMutex
+	roleCache     map[string]*cachedChefRole
+
+	clientLock sync.Mutex
+	// mappingLock serializes writes to the environment, Chef role and client
+	// pattern mappings and to the config with imports, which take it before
+	// clientLock
+	mappingLock sync.Mutex
+
+	tokenLock sync.Mutex
+
+	// endpointDown holds when each failed Chef server endpoint can be tried
+	// again
+	endpointLock sync.Mutex
+	endpointDown map[string]time.Time
+
+	tidyRunning int32
+}
+
+// periodicFunc prunes the records of expired tokens and runs the periodic
+// tidy of client mappings.
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	if err := b.pruneTokens(ctx, req.Storage); err != nil {
+		return err
+	}
+	return b.periodicTidy(ctx, req)
 }
 
 func parsePrivateKey(key string) (*rsa.PrivateKey, error) {
@@ -65,8 +123,12 @@ and signature version such as those generated by the mixlib-authentication
 rubygem used by chef to authenticate a chef client against a chef server.
 Currently only version 1.0 of the chef signing algorithm is supported.
 
-Policies can be assigned based on chef environment, roles, and tags that are
-assigned to the node in chef.  These are configured using the 'environment/<environment>',
-'role/<role>', and 'tag/<tag>' endpoints.  The node will get the union of the
-policies for the environment, roles, and tags that are applied to it.
+Policies can be assigned based on the chef client, environment, and roles that are
+assigned to the node in chef.  These are configured using the 'client/<client>',
+'environment/<environment>', and 'chef_role/<role>' endpoints.  The node will get the
+union of the policies for the client, environment, and expanded roles that apply to it.
+
+Alternatively a node can log in with a named Vault role configured using the
+'role/<name>' endpoint.  The token then receives only the role's policies, and
+the login only succeeds if the node satisfies all of the role's bound constraints.
 `
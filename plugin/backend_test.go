@@ -8,15 +8,21 @@ import (
 	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	"fmt"
 
 	"bytes"
 	"encoding/json"
 
+	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
 
 	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	logicaltest "github.com/hashicorp/vault/logical/testing"
 )
@@ -236,6 +242,2173 @@ ywIDAQAB
 	}
 }
 
+func TestBackend_RoleValidateNode(t *testing.T) {
+	role := &RoleEntry{
+		BoundEnvironments: []string{"prod"},
+		BoundChefRoles:    []string{"web", "db"},
+		BoundClientNames:  []string{"app-prod-*"},
+	}
+	node := &chefNode{
+		Environment: "prod",
+		RunList:     []string{"recipe[base]", "role[web]"},
+	}
+
+	if err := role.validateNode("app-prod-01", node, node.Roles()); err != nil {
+		t.Fatalf("expected node to satisfy role: %s", err)
+	}
+	if err := role.validateNode("app-dev-01", node, node.Roles()); err == nil {
+		t.Fatal("role accepted client name outside of bound_client_names")
+	}
+
+	node.Environment = "dev"
+	if err := role.validateNode("app-prod-01", node, node.Roles()); err == nil {
+		t.Fatal("role accepted node outside of bound_environments")
+	}
+
+	node.Environment = "prod"
+	node.RunList = []string{"role[cache]"}
+	if err := role.validateNode("app-prod-01", node, node.Roles()); err == nil {
+		t.Fatal("role accepted node without any bound_chef_roles")
+	}
+}
+
+func TestBackend_RoleLogin(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "staging",
+		},
+	}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	web01 := testChefClient(t, objects, ts.URL, "web01")
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "role/deploy",
+		Data: map[string]interface{}{
+			"bound_environments": "prod",
+			"token_policies":     "deploy",
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't write role: %v %v", err, resp)
+	}
+
+	login := func(role string) (*logical.Response, error) {
+		data := testLoginData(t, web01)
+		data["role"] = role
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      data,
+			Storage:   storage,
+		})
+	}
+
+	// A missing role and unmet bounds are refused
+	for _, role := range []string{"nope", "deploy"} {
+		resp, err := login(role)
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected login with role %s to be refused, got: %v %v", role, err, resp)
+		}
+	}
+
+	// Failing to fetch the node is an internal error
+	delete(objects, "/nodes/web01")
+	if _, err := login("deploy"); err == nil {
+		t.Fatal("expected an error when the node couldn't be fetched")
+	}
+}
+
+func TestBackend_RenderPolicies(t *testing.T) {
+	node := &chefNode{
+		Environment: "prod",
+		Normal: map[string]interface{}{
+			"team":  "Payments",
+			"owner": "ops,root",
+		},
+		Automatic: map[string]interface{}{
+			"platform": "ubuntu",
+		},
+	}
+
+	pols := renderPolicies([]string{
+		"base",
+		"app-{{chef_environment}}",
+		"team-{{normal.team}}-read",
+		"os-{{platform}}",
+		"missing-{{normal.nope}}",
+		"owner-{{normal.owner}}",
+	}, node)
+	exPols := []string{"base", "app-prod", "team-payments-read", "os-ubuntu"}
+	if !policyutil.EquivalentPolicies(exPols, pols) {
+		t.Fatalf("policies didn't match:\nexpected: %#v\ngot: %#v\n", exPols, pols)
+	}
+
+	if err := validateTemplate("app-{{chef_environment}"); err == nil {
+		t.Fatal("malformed template was accepted")
+	}
+}
+
+func TestBackend_ResolvePolicies(t *testing.T) {
+	mappings := []*policyMapping{
+		&policyMapping{
+			Kind:     "client",
+			Name:     "web01",
+			Policies: []string{"web", "admin"},
+		},
+		&policyMapping{
+			Kind:     "default",
+			Name:     "config",
+			Policies: []string{"base"},
+		},
+		&policyMapping{
+			Kind:           "environment",
+			Name:           "prod",
+			Policies:       []string{"prod"},
+			DeniedPolicies: []string{"admin"},
+		},
+	}
+
+	pols, err := resolvePolicies(&config{}, nil, mappings, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exPols := []string{"web", "base", "prod"}
+	if !policyutil.EquivalentPolicies(exPols, pols) {
+		t.Fatalf("policies didn't match:\nexpected: %#v\ngot: %#v\n", exPols, pols)
+	}
+
+	pols, err = resolvePolicies(&config{}, &policyMapping{
+		Kind:     "role",
+		Name:     "deploy",
+		Policies: []string{"deploy", "admin"},
+	}, mappings, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exPols = []string{"deploy"}
+	if !policyutil.EquivalentPolicies(exPols, pols) {
+		t.Fatalf("policies didn't match:\nexpected: %#v\ngot: %#v\n", exPols, pols)
+	}
+
+	// A templated denial removes the policy it renders to
+	loader := &nodeLoader{loaded: true, node: &chefNode{
+		Normal: map[string]interface{}{"team": "web"},
+	}}
+	mappings[2].DeniedPolicies = []string{"{{normal.team}}"}
+	pols, err = resolvePolicies(&config{}, nil, mappings, true, loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exPols = []string{"admin", "base", "prod"}
+	if !policyutil.EquivalentPolicies(exPols, pols) {
+		t.Fatalf("policies didn't match:\nexpected: %#v\ngot: %#v\n", exPols, pols)
+	}
+
+	// A templated denial that can't be rendered refuses login instead of
+	// being dropped
+	mappings[2].DeniedPolicies = []string{"{{normal.nope}}"}
+	_, err = resolvePolicies(&config{}, nil, mappings, true, loader)
+	if _, ok := err.(*unrenderedDenialError); !ok {
+		t.Fatalf("expected login to be denied, got: %v", err)
+	}
+
+	mappings[2].DeniedPolicies = []string{"admin"}
+	mappings[2].DenyLogin = true
+	_, err = resolvePolicies(&config{}, nil, mappings, true, nil)
+	if _, ok := err.(*loginDeniedError); !ok {
+		t.Fatalf("expected login to be denied, got: %v", err)
+	}
+}
+
+func TestBackend_PolicyCeiling(t *testing.T) {
+	conf := &config{
+		AllowedPolicies:    []string{"app-*", "base"},
+		DisallowedPolicies: []string{"app-admin*"},
+	}
+
+	if err := conf.checkPolicies([]string{"default", "base", "app-web", "app-{{chef_environment}}"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.checkPolicies([]string{"root"}); err == nil {
+		t.Fatal("policy outside of allowed_policies was accepted")
+	}
+	if err := conf.checkPolicies([]string{"app-admin-prod"}); err == nil {
+		t.Fatal("policy matching disallowed_policies was accepted")
+	}
+
+	for policy, permitted := range map[string]bool{
+		"base":      true,
+		"root":      false,
+		"app-web":   true,
+		"app-admin": false,
+	} {
+		if conf.permitsPolicy(policy) != permitted {
+			t.Fatalf("expected permitsPolicy(%q) to be %t", policy, permitted)
+		}
+	}
+}
+
+func TestBackend_ConfigUpdateMerges(t *testing.T) {
+	ctx := context.Background()
+	b, storage := testBackendWithChefServer(t, "https://chef.example.com")
+
+	write := func(data map[string]interface{}) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write config: %v %v", err, resp)
+		}
+	}
+	write(map[string]interface{}{
+		"allowed_policies":  "app-*",
+		"max_active_tokens": 5,
+		"require_approval":  true,
+	})
+
+	// Rotating the key leaves every other field alone
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}))
+	write(map[string]interface{}{
+		"client_key": keyPEM,
+	})
+
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientKey != keyPEM || cfg.BaseURL != "https://chef.example.com" || cfg.ClientName != "vault" {
+		t.Fatalf("unexpected connection settings: %#v", cfg)
+	}
+	if !strutil.EquivalentSlices(cfg.AllowedPolicies, []string{"app-*"}) || cfg.MaxActiveTokens != 5 || !cfg.RequireApproval {
+		t.Fatalf("config update cleared fields: %#v", cfg)
+	}
+	if cfg.RenewalPolicyChange != "deny" || cfg.AliasSource != "client_name" || cfg.GroupAliasRolePrefix != "role:" {
+		t.Fatalf("defaults weren't applied: %#v", cfg)
+	}
+
+	// Fields can still be cleared explicitly
+	write(map[string]interface{}{
+		"allowed_policies": "",
+	})
+	cfg, err = b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.AllowedPolicies) != 0 {
+		t.Fatalf("allowed_policies wasn't cleared: %v", cfg.AllowedPolicies)
+	}
+}
+
+func TestBackend_ClientPatterns(t *testing.T) {
+	config := logical.TestBackendConfig()
+	storage := &logical.InmemStorage{}
+	config.StorageView = storage
+	ctx := context.Background()
+	b := Backend()
+	err := b.Setup(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := map[string]map[string]interface{}{
+		"web": map[string]interface{}{
+			"pattern":  "web-*",
+			"policies": "web",
+			"priority": 10,
+		},
+		"web-prod": map[string]interface{}{
+			"pattern":      `web-prod-\d+`,
+			"pattern_type": "regex",
+			"policies":     "web-prod",
+			"priority":     1,
+		},
+	}
+	for name, data := range patterns {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "client_pattern/" + name,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write client pattern %s: %v %v", name, err, resp)
+		}
+	}
+
+	cases := map[string]string{
+		"web-prod-01": "web-prod",
+		"web-dev-01":  "web",
+		"db-prod-01":  "",
+	}
+	for client, expected := range cases {
+		name, _, err := b.matchClientPattern(ctx, storage, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != expected {
+			t.Fatalf("client %s matched %q, expected %q", client, name, expected)
+		}
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client_pattern/bad",
+		Data: map[string]interface{}{
+			"pattern":      "web-(",
+			"pattern_type": "regex",
+		},
+		Storage: storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("invalid regex was accepted")
+	}
+}
+
+func TestBackend_ExpandRoles(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestChefServer(map[string]interface{}{
+		"/roles/webserver": map[string]interface{}{
+			"name":     "webserver",
+			"run_list": []string{"role[base]", "recipe[nginx]"},
+		},
+		"/roles/base": map[string]interface{}{
+			"name":     "base",
+			"run_list": []string{"recipe[base]"},
+			"env_run_lists": map[string]interface{}{
+				"prod": []string{"role[hardening]", "role[webserver]"},
+			},
+		},
+		"/roles/hardening": map[string]interface{}{
+			"name":     "hardening",
+			"run_list": []string{"role[base]"},
+		},
+	})
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	req := &logical.Request{Storage: storage}
+
+	node := &chefNode{
+		Environment: "dev",
+		RunList:     []string{"role[webserver]"},
+	}
+	roles, err := b.expandRoles(ctx, req, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.EquivalentSlices(roles, []string{"webserver", "base"}) {
+		t.Fatalf("unexpected dev roles: %#v", roles)
+	}
+
+	node.Environment = "prod"
+	roles, err = b.expandRoles(ctx, req, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.EquivalentSlices(roles, []string{"webserver", "base", "hardening"}) {
+		t.Fatalf("unexpected prod roles: %#v", roles)
+	}
+
+	node.Automatic = map[string]interface{}{
+		"roles": []interface{}{"webserver", "base", "ohai"},
+	}
+	roles, err = b.expandRoles(ctx, req, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.EquivalentSlices(roles, []string{"webserver", "base", "ohai"}) {
+		t.Fatalf("automatic roles weren't used: %#v", roles)
+	}
+}
+
+func TestBackend_Explain(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestChefServer(map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+		},
+		"/nodes/web02": map[string]interface{}{
+			"name":             "web02",
+			"chef_environment": "dev",
+		},
+	})
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+
+	writes := map[string]map[string]interface{}{
+		"client/web01": map[string]interface{}{
+			"policies":          "web,admin",
+			"max_active_tokens": 1,
+		},
+		"environment/prod": map[string]interface{}{
+			"policies":        "prod,web",
+			"denied_policies": "admin",
+		},
+	}
+	for path, data := range writes {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write %s: %v %v", path, err, resp)
+		}
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "explain/web01",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("explain failed: %v %v", err, resp)
+	}
+
+	exPols := []string{"web", "prod"}
+	if !policyutil.EquivalentPolicies(exPols, resp.Data["policies"].([]string)) {
+		t.Fatalf("policies didn't match:\nexpected: %#v\ngot: %#v\n", exPols, resp.Data["policies"])
+	}
+	sources := resp.Data["sources"].(map[string][]string)
+	if !strutil.EquivalentSlices(sources["web"], []string{"client:web01", "environment:prod"}) {
+		t.Fatalf("unexpected sources for web: %#v", sources["web"])
+	}
+	denied := resp.Data["denied_policies"].(map[string][]string)
+	if !strutil.EquivalentSlices(denied["admin"], []string{"environment:prod"}) {
+		t.Fatalf("unexpected denials for admin: %#v", denied["admin"])
+	}
+	if !resp.Data["login_allowed"].(bool) {
+		t.Fatalf("unexpected failed gates: %#v", resp.Data["failed_gates"])
+	}
+
+	// Clients at their token limit or waiting for approval can't log in
+	entry, err := logical.StorageEntryJSON("token/web01/1", &activeTokenEntry{
+		IssuedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"require_approval": true,
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't write config: %v %v", err, resp)
+	}
+	for client, gate := range map[string]string{
+		"web01": (&tokenLimitError{client: "web01", limit: 1}).Error(),
+		"web02": `client "web02" requires approval`,
+	} {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "explain/" + client,
+			Storage:   storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("explain failed: %v %v", err, resp)
+		}
+		gates := resp.Data["failed_gates"].([]string)
+		if resp.Data["login_allowed"].(bool) || len(gates) != 1 || gates[0] != gate {
+			t.Fatalf("unexpected failed gates of %s: %#v", client, gates)
+		}
+	}
+}
+
+func TestBackend_PreviewMappingChange(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestChefServer(map[string]interface{}{})
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+
+	for _, client := range []string{"web01", "web02"} {
+		if err := b.recordLogin(ctx, storage, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client/web01",
+		Data: map[string]interface{}{
+			"policies": "web,old",
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't write client: %v %v", err, resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client/web01",
+		Data: map[string]interface{}{
+			"policies": "web,new",
+			"preview":  true,
+		},
+		Storage: storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("preview failed: %v %v", err, resp)
+	}
+
+	changes := resp.Data["changes"].(map[string]interface{})
+	if len(changes) != 1 {
+		t.Fatalf("expected only web01 to change: %#v", changes)
+	}
+	change := changes["web01"].(map[string]interface{})
+	if !strutil.EquivalentSlices(change["added_policies"].([]string), []string{"new"}) {
+		t.Fatalf("unexpected added policies: %#v", change)
+	}
+	if !strutil.EquivalentSlices(change["removed_policies"].([]string), []string{"old"}) {
+		t.Fatalf("unexpected removed policies: %#v", change)
+	}
+
+	client, err := b.Client(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.EquivalentSlices(client.Policies, []string{"web", "old"}) {
+		t.Fatalf("preview modified storage: %#v", client.Policies)
+	}
+
+	// A config preview keeps the cached Chef roles
+	b.roleCache["base"] = &cachedChefRole{role: &chefRole{}, expires: time.Now().Add(time.Hour)}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"default_policies": "base",
+			"preview":          true,
+		},
+		Storage: storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("preview failed: %v %v", err, resp)
+	}
+	changes = resp.Data["changes"].(map[string]interface{})
+	if len(changes) != 2 {
+		t.Fatalf("expected both clients to change: %#v", changes)
+	}
+	if _, ok := b.roleCache["base"]; !ok {
+		t.Fatal("config preview reset the role cache")
+	}
+}
+
+func TestBackend_ImportExport(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestChefServer(map[string]interface{}{})
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client/stale",
+		Data: map[string]interface{}{
+			"policies": "stale",
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't write client: %v %v", err, resp)
+	}
+
+	doc := map[string]interface{}{
+		"default_policies": []interface{}{"base"},
+		"clients": map[string]interface{}{
+			"web01": map[string]interface{}{
+				"policies": []interface{}{"web"},
+			},
+		},
+		"client_patterns": map[string]interface{}{
+			"db": map[string]interface{}{
+				"pattern":  "db-*",
+				"policies": []interface{}{"db"},
+			},
+		},
+		"environments": map[string]interface{}{
+			"quarantine": map[string]interface{}{
+				"deny_login": true,
+			},
+		},
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "import",
+		Data: map[string]interface{}{
+			"mappings": doc,
+			"mode":     "replace",
+		},
+		Storage: storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("import failed: %v %v", err, resp)
+	}
+
+	stale, err := b.Client(ctx, storage, "stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != nil {
+		t.Fatal("replace import didn't delete client missing from the document")
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "export",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("export failed: %v %v", err, resp)
+	}
+	exported := resp.Data["mappings"].(map[string]interface{})
+	if len(exported["clients"].(map[string]interface{})) != 1 {
+		t.Fatalf("unexpected exported clients: %#v", exported["clients"])
+	}
+	pattern := exported["client_patterns"].(map[string]interface{})["db"].(map[string]interface{})
+	if pattern["pattern_type"] != "glob" {
+		t.Fatalf("unexpected exported client pattern: %#v", pattern)
+	}
+	env := exported["environments"].(map[string]interface{})["quarantine"].(map[string]interface{})
+	if env["deny_login"] != true {
+		t.Fatalf("unexpected exported environment: %#v", env)
+	}
+
+	// A document with an invalid mapping must not change anything
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "import",
+		Data: map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"clients": map[string]interface{}{
+					"web02": map[string]interface{}{
+						"policies": []interface{}{"web"},
+					},
+				},
+				"client_patterns": map[string]interface{}{
+					"bad": map[string]interface{}{
+						"pattern":      "(",
+						"pattern_type": "regex",
+					},
+				},
+			},
+		},
+		Storage: storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("import with invalid mapping was accepted")
+	}
+	web02, err := b.Client(ctx, storage, "web02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web02 != nil {
+		t.Fatal("failed import wrote a mapping")
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "import",
+		Data: map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"clients": map[string]interface{}{
+					"web02": map[string]interface{}{
+						"policies":          []interface{}{"web"},
+						"max_active_tokens": -1,
+					},
+				},
+			},
+		},
+		Storage: storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("import with a negative max_active_tokens was accepted")
+	}
+}
+
+func TestBackend_ClientVersions(t *testing.T) {
+	config := logical.TestBackendConfig()
+	storage := &logical.InmemStorage{}
+	config.StorageView = storage
+	ctx := context.Background()
+	b := Backend()
+	err := b.Setup(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for i := 1; i <= clientVersionHistory+3; i++ {
+		resp := write("client/web01", map[string]interface{}{
+			"policies": fmt.Sprintf("web-%d", i),
+			"cas":      i - 1,
+		})
+		if resp == nil || resp.IsError() || resp.Data["version"] != i {
+			t.Fatalf("unexpected response writing version %d: %v", i, resp)
+		}
+	}
+
+	resp := write("client/web01", map[string]interface{}{
+		"policies": "web",
+		"cas":      1,
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatal("write with stale cas was accepted")
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "client_versions/web01",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't read versions: %v %v", err, resp)
+	}
+	versions := resp.Data["versions"].(map[string]interface{})
+	if len(versions) != clientVersionHistory+1 {
+		t.Fatalf("expected %d versions, got %d", clientVersionHistory+1, len(versions))
+	}
+	if _, ok := versions["1"]; ok {
+		t.Fatal("oldest version wasn't pruned")
+	}
+
+	resp = write("client_rollback/web01", map[string]interface{}{
+		"version": 5,
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("rollback failed: %v", resp)
+	}
+	client, err := b.Client(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Version != clientVersionHistory+4 || !strutil.EquivalentSlices(client.Policies, []string{"web-5"}) {
+		t.Fatalf("unexpected client after rollback: %#v", client)
+	}
+
+	// A rollback keeps the current key fingerprint
+	for _, fp := range []string{"aaaa", "bbbb"} {
+		resp = write("client/web01", map[string]interface{}{
+			"policies":        "web-" + fp,
+			"key_fingerprint": fp,
+		})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("couldn't write client: %v", resp)
+		}
+	}
+	resp = write("client_rollback/web01", map[string]interface{}{
+		"version": clientVersionHistory + 5,
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("rollback failed: %v", resp)
+	}
+	client, err = b.Client(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.KeyFingerprint != "bbbb" || !strutil.EquivalentSlices(client.Policies, []string{"web-aaaa"}) {
+		t.Fatalf("unexpected client after rollback: %#v", client)
+	}
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "client_versions/web01",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't read versions: %v %v", err, resp)
+	}
+	versions = resp.Data["versions"].(map[string]interface{})
+	old := versions[fmt.Sprint(clientVersionHistory+5)].(map[string]interface{})
+	if old["key_fingerprint"] != "aaaa" {
+		t.Fatalf("unexpected version: %#v", old)
+	}
+
+	// Imports store new mappings as version 1 and prune the history
+	for i := 0; i < clientVersionHistory+2; i++ {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "import",
+			Data: map[string]interface{}{
+				"mappings": map[string]interface{}{
+					"clients": map[string]interface{}{
+						"web01": map[string]interface{}{"policies": []string{"web"}},
+						"web02": map[string]interface{}{"policies": []string{"web"}},
+					},
+				},
+			},
+			Storage: storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("import failed: %v %v", err, resp)
+		}
+		if i == 0 {
+			client, err := b.Client(ctx, storage, "web02")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.Version != 1 {
+				t.Fatalf("imported mapping has version %d", client.Version)
+			}
+		}
+	}
+	history, err := clientVersions(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != clientVersionHistory {
+		t.Fatalf("expected %d versions in the history, got %d", clientVersionHistory, len(history))
+	}
+
+	// Mappings written before versioning are version 1, so cas=0 can't
+	// overwrite them
+	entry, err := logical.StorageEntryJSON("client/legacy", &ClientEntry{
+		Policies: []string{"legacy"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	resp = write("client/legacy", map[string]interface{}{
+		"policies": "web",
+		"cas":      0,
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("cas=0 overwrote an existing mapping: %v", resp)
+	}
+	resp = write("client/legacy", map[string]interface{}{
+		"policies": "web",
+		"cas":      1,
+	})
+	if resp == nil || resp.IsError() || resp.Data["version"] != 2 {
+		t.Fatalf("unexpected response updating a legacy mapping: %v", resp)
+	}
+}
+
+func TestBackend_ClientExpiryAndDisable(t *testing.T) {
+	config := logical.TestBackendConfig()
+	storage := &logical.InmemStorage{}
+	config.StorageView = storage
+	ctx := context.Background()
+	b := Backend()
+	err := b.Setup(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clients := map[string]map[string]interface{}{
+		"web-expired": map[string]interface{}{
+			"policies":   "web",
+			"expires_at": time.Now().Add(-time.Hour).Format(time.RFC3339),
+		},
+		"web-disabled": map[string]interface{}{
+			"policies": "web",
+			"disabled": true,
+		},
+		"web01": map[string]interface{}{
+			"policies":    "web",
+			"owner":       "web-team",
+			"description": "frontend",
+			"expires_at":  time.Now().Add(time.Hour).Format(time.RFC3339),
+		},
+	}
+	for name, data := range clients {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "client/" + name,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write client %s: %v %v", name, err, resp)
+		}
+	}
+
+	req := &logical.Request{Storage: storage}
+	policies, err := b.getNodePolicies(ctx, req, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strutil.EquivalentSlices(policies, []string{"web"}) {
+		t.Fatalf("unexpected policies for web01: %v", policies)
+	}
+
+	policies, err = b.getNodePolicies(ctx, req, "web-expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 0 {
+		t.Fatalf("expired mapping still applied: %v", policies)
+	}
+
+	_, err = b.getNodePolicies(ctx, req, "web-disabled")
+	if _, ok := err.(*loginDeniedError); !ok {
+		t.Fatalf("disabled client wasn't denied: %v", err)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "clients/",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't list clients: %v %v", err, resp)
+	}
+	info := resp.Data["key_info"].(map[string]interface{})["web01"].(map[string]interface{})
+	if info["owner"] != "web-team" || info["description"] != "frontend" {
+		t.Fatalf("unexpected key_info for web01: %#v", info)
+	}
+}
+
+func TestBackend_PendingApproval(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+			"automatic": map[string]interface{}{
+				"fqdn": "web01.example.com",
+			},
+		},
+		"/nodes/db01": map[string]interface{}{
+			"name":             "db01",
+			"chef_environment": "staging",
+		},
+	}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+	db01 := testChefClient(t, objects, ts.URL, "db01")
+
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RequireApproval = true
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(client *config) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation:  logical.UpdateOperation,
+			Path:       "login",
+			Data:       testLoginData(t, client),
+			Storage:    storage,
+			Connection: &logical.Connection{RemoteAddr: "10.0.0.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := login(client)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("unknown client logged in: %v", resp)
+	}
+
+	// Environment and pattern mappings are chosen by the node itself or match
+	// any name, so they don't let a new client skip approval
+	for path, data := range map[string]map[string]interface{}{
+		"environment/staging": {"policies": "db"},
+		"client_pattern/all":  {"pattern": "*", "policies": "any"},
+	} {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write %s: %v %v", path, err, resp)
+		}
+	}
+	resp = login(db01)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("client with only environment and pattern mappings logged in: %v", resp)
+	}
+	if pending, err := b.PendingClient(ctx, storage, "db01"); err != nil || pending == nil {
+		t.Fatalf("client wasn't queued: %v %v", pending, err)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "pending/web01",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't read pending client: %v %v", err, resp)
+	}
+	if resp.Data["source_ip"] != "10.0.0.1" || resp.Data["key_fingerprint"] == "" {
+		t.Fatalf("unexpected pending client: %#v", resp.Data)
+	}
+	fingerprint := resp.Data["key_fingerprint"]
+	node := resp.Data["node"].(map[string]interface{})
+	if node["chef_environment"] != "prod" || node["fqdn"] != "web01.example.com" {
+		t.Fatalf("unexpected node summary: %#v", node)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "pending/web01",
+		Data: map[string]interface{}{
+			"action":   "approve",
+			"policies": "web",
+		},
+		Storage: storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't approve client: %v %v", err, resp)
+	}
+	pending, err := b.PendingClient(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != nil {
+		t.Fatal("approved client is still pending")
+	}
+
+	resp = login(client)
+	if resp == nil || resp.IsError() || resp.Auth == nil {
+		t.Fatalf("approved client couldn't log in: %v", resp)
+	}
+	if !strutil.EquivalentSlices(resp.Auth.Policies, []string{"web"}) {
+		t.Fatalf("unexpected policies: %v", resp.Auth.Policies)
+	}
+
+	// The mapping is pinned to the approved key, also across updates
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client/web01",
+		Data: map[string]interface{}{
+			"policies": "web,app",
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't update client: %v %v", err, resp)
+	}
+	mapping, err := b.Client(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.KeyFingerprint != fingerprint {
+		t.Fatalf("expected key fingerprint %v, got %q", fingerprint, mapping.KeyFingerprint)
+	}
+	rotated := testChefClient(t, objects, ts.URL, "web01")
+	resp = login(rotated)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("client logged in with a key other than the approved one: %v", resp)
+	}
+}
+
+func TestBackend_Quarantine(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Data:      testLoginData(t, client),
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v %v", err, resp)
+	}
+	auth := resp.Auth
+
+	renew := func() error {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Path:      "login",
+			Auth:      auth,
+			Storage:   storage,
+		})
+		return err
+	}
+	if err := renew(); err != nil {
+		t.Fatalf("couldn't renew token: %v", err)
+	}
+
+	quarantines := map[string]map[string]interface{}{
+		"web01": map[string]interface{}{
+			"reason": "incident 42",
+		},
+		"web02": map[string]interface{}{
+			"reason":     "lifted",
+			"expires_at": time.Now().Add(-time.Minute).Format(time.RFC3339),
+		},
+	}
+	for name, data := range quarantines {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "quarantine/" + name,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't quarantine %s: %v %v", name, err, resp)
+		}
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "quarantines/",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't list quarantines: %v %v", err, resp)
+	}
+	if keys := resp.Data["keys"].([]string); len(keys) != 1 || keys[0] != "web01" {
+		t.Fatalf("unexpected active quarantines: %v", keys)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Data:      testLoginData(t, client),
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() {
+		t.Fatal("quarantined client logged in")
+	}
+
+	// The quarantine isn't revealed to callers that can't sign as the client
+	data := testLoginData(t, client)
+	data["signature"] = "Zm9yZ2Vk"
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Data:      data,
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || !resp.IsError() || resp.Error().Error() != "Couldn't authenticate client" {
+		t.Fatalf("unexpected response to a forged login: %v", resp)
+	}
+
+	if err := renew(); err == nil {
+		t.Fatal("quarantined client renewed its token")
+	}
+}
+
+func TestBackend_Freeze(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+		},
+		"/nodes/web02": map[string]interface{}{
+			"name":             "web02",
+			"chef_environment": "staging",
+		},
+	}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	web01 := testChefClient(t, objects, ts.URL, "web01")
+	web02 := testChefClient(t, objects, ts.URL, "web02")
+
+	write := func(path string, data map[string]interface{}) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write %s: %v %v", path, err, resp)
+		}
+	}
+	login := func(client *config) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      testLoginData(t, client),
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	write("freeze/prod", map[string]interface{}{
+		"message": "prod is migrating policies",
+	})
+	resp := login(web01)
+	if resp == nil || !resp.IsError() || resp.Data["error"] != "prod is migrating policies" {
+		t.Fatalf("frozen environment logged in: %v", resp)
+	}
+	resp = login(web02)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("unfrozen environment couldn't log in: %v", resp)
+	}
+	// A client without a node object isn't in a frozen environment
+	resp = login(testChefClient(t, objects, ts.URL, "web03"))
+	if resp == nil || resp.IsError() {
+		t.Fatalf("client without a node couldn't log in: %v", resp)
+	}
+
+	write("freeze", map[string]interface{}{
+		"ends_at": time.Now().Add(time.Hour).Format(time.RFC3339),
+	})
+	resp = login(web02)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("global freeze didn't apply: %v", resp)
+	}
+
+	write("freeze", map[string]interface{}{
+		"ends_at": time.Now().Add(-time.Hour).Format(time.RFC3339),
+	})
+	resp = login(web02)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("ended freeze still applied: %v", resp)
+	}
+}
+
+func TestBackend_Tidy(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestChefServer(map[string]interface{}{
+		"/clients": map[string]interface{}{
+			"web01": "https://chef.example.com/clients/web01",
+		},
+	})
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+
+	for _, name := range []string{"web01", "gone01"} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "client/" + name,
+			Data: map[string]interface{}{
+				"policies": "web",
+			},
+			Storage: storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write client %s: %v %v", name, err, resp)
+		}
+	}
+
+	tidy := func(remove bool) map[string]interface{} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "tidy",
+			Data: map[string]interface{}{
+				"remove": remove,
+			},
+			Storage: storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("tidy failed: %v %v", err, resp)
+		}
+		return resp.Data
+	}
+
+	// Within the grace period nothing is removed
+	data := tidy(true)
+	if _, ok := data["missing"].(map[string]interface{})["gone01"]; !ok {
+		t.Fatalf("missing client wasn't reported: %#v", data)
+	}
+	if len(data["removed"].([]string)) != 0 {
+		t.Fatalf("client was removed within the grace period: %#v", data)
+	}
+
+	status, err := b.tidyStatus(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status.Missing["gone01"] = time.Now().Add(-2 * defaultTidyGracePeriod)
+	entry, err := logical.StorageEntryJSON("tidy_status", status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	data = tidy(true)
+	if removed := data["removed"].([]string); len(removed) != 1 || removed[0] != "gone01" {
+		t.Fatalf("unexpected removed clients: %#v", data)
+	}
+	gone, err := b.Client(ctx, storage, "gone01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gone != nil {
+		t.Fatal("stale client mapping wasn't removed")
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tidy/status",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't read tidy status: %v %v", err, resp)
+	}
+	if resp.Data["checked"] != 2 {
+		t.Fatalf("unexpected tidy status: %#v", resp.Data)
+	}
+
+	// Mappings written or logged in with after the run started are kept
+	start := time.Now()
+	client, err := b.Client(ctx, storage, "web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := b.tidyChanged(ctx, storage, "web01", client.Version, start)
+	if err != nil || changed {
+		t.Fatalf("unchanged mapping was reported as changed: %t %v", changed, err)
+	}
+	changed, err = b.tidyChanged(ctx, storage, "web01", client.Version-1, start)
+	if err != nil || !changed {
+		t.Fatalf("rewritten mapping wasn't reported as changed: %t %v", changed, err)
+	}
+	if err := b.recordLogin(ctx, storage, "web01"); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = b.tidyChanged(ctx, storage, "web01", client.Version, start)
+	if err != nil || !changed {
+		t.Fatalf("login wasn't reported as a change: %t %v", changed, err)
+	}
+}
+
+func TestBackend_RenewRevalidates(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Data:      testLoginData(t, client),
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v %v", err, resp)
+	}
+	auth := resp.Auth
+	if _, ok := auth.InternalData["signature"]; ok {
+		t.Fatal("login signature was stored in the token")
+	}
+
+	renew := func() error {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Path:      "login",
+			Auth:      auth,
+			Storage:   storage,
+		})
+		return err
+	}
+	if err := renew(); err != nil {
+		t.Fatalf("couldn't renew token: %v", err)
+	}
+
+	// Rotating the client's key breaks key continuity
+	testChefClient(t, objects, ts.URL, "web01")
+	if err := renew(); err == nil {
+		t.Fatal("token was renewed after the client's key changed")
+	}
+
+	delete(objects, "/clients/web01/keys")
+	if err := renew(); err == nil {
+		t.Fatal("token was renewed after the client was deleted")
+	}
+}
+
+func TestBackend_RenewalPolicyChange(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+
+	setPolicies := func(policies string) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "client/web01",
+			Data: map[string]interface{}{
+				"policies": policies,
+			},
+			Storage: storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write client: %v %v", err, resp)
+		}
+	}
+	setMode := func(mode string) {
+		config, err := b.Config(ctx, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.RenewalPolicyChange = mode
+		entry, err := logical.StorageEntryJSON("config", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setPolicies("web")
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "login",
+		Data:      testLoginData(t, client),
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v %v", err, resp)
+	}
+	auth := resp.Auth
+	renew := func() (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Path:      "login",
+			Auth:      auth,
+			Storage:   storage,
+		})
+	}
+
+	cases := []struct {
+		mode     string
+		policies string
+		renewed  bool
+	}{
+		{"deny", "web,metrics", false},
+		{"allow_subset", "web,metrics", true},
+		{"allow_subset", "metrics", false},
+		{"allow", "metrics", true},
+	}
+	for _, c := range cases {
+		setMode(c.mode)
+		setPolicies(c.policies)
+		resp, err := renew()
+		if c.renewed != (err == nil) {
+			t.Fatalf("mode %s with policies %s: expected renewed %t, got %v", c.mode, c.policies, c.renewed, err)
+		}
+		if c.renewed && (resp == nil || len(resp.Warnings) == 0) {
+			t.Fatalf("mode %s with policies %s: expected a warning, got %v", c.mode, c.policies, resp)
+		}
+	}
+}
+
+func TestBackend_MaxActiveTokens(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client/web01",
+		Data: map[string]interface{}{
+			"policies":          "web",
+			"max_active_tokens": 2,
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't write client: %v %v", err, resp)
+	}
+
+	login := func() *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      testLoginData(t, client),
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := login(); resp == nil || resp.IsError() {
+			t.Fatalf("login %d failed: %v", i, resp)
+		}
+	}
+	if resp := login(); resp == nil || !resp.IsError() {
+		t.Fatalf("login above the limit was allowed: %v", resp)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "client_tokens/web01",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't read tokens: %v %v", err, resp)
+	}
+	if resp.Data["active_tokens"] != 2 || resp.Data["max_active_tokens"] != 2 {
+		t.Fatalf("unexpected tokens: %#v", resp.Data)
+	}
+
+	// Expired tokens no longer count against the limit
+	tokens, err := storage.List(ctx, "token/web01/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := logical.StorageEntryJSON("token/web01/"+tokens[0], &activeTokenEntry{
+		IssuedAt:  time.Now().Add(-2 * time.Hour),
+		ExpiresAt: time.Now().Add(-time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	if resp := login(); resp == nil || resp.IsError() {
+		t.Fatalf("login after a token expired failed: %v", resp)
+	}
+
+	// Records of revoked tokens can be forgotten one at a time or all at once
+	forget := func(path string) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      path,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't delete tokens: %v %v", err, resp)
+		}
+	}
+	tokens, err = storage.List(ctx, "token/web01/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forget("client_token/web01/" + tokens[0])
+	if resp := login(); resp == nil || resp.IsError() {
+		t.Fatalf("login after forgetting a token failed: %v", resp)
+	}
+	forget("client_tokens/web01")
+	tokens, err = storage.List(ctx, "token/web01/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("token records weren't deleted: %v", tokens)
+	}
+
+	// A refused login leaves no record behind
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "client/web01",
+		Data: map[string]interface{}{
+			"deny_login": true,
+		},
+		Storage: storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't write client: %v %v", err, resp)
+	}
+	if resp := login(); resp == nil || !resp.IsError() {
+		t.Fatalf("denied login was allowed: %v", resp)
+	}
+	tokens, err = storage.List(ctx, "token/web01/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("refused login left a token record: %v", tokens)
+	}
+}
+
+func TestBackend_IdentityAlias(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+			"policy_group":     "prod-group",
+			"automatic": map[string]interface{}{
+				"fqdn":      "web01.example.com",
+				"chef_guid": "6c3b7ea1-1d2f-4a4e-9f3e-0f1c2d3e4f5a",
+				"platform":  "ubuntu",
+			},
+		},
+	}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	web01 := testChefClient(t, objects, ts.URL, "web01")
+	web02 := testChefClient(t, objects, ts.URL, "web02")
+
+	login := func(client *config) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      testLoginData(t, client),
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := login(web01)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v", resp)
+	}
+	if resp.Auth.Alias == nil || resp.Auth.Alias.Name != "web01" {
+		t.Fatalf("unexpected alias: %#v", resp.Auth.Alias)
+	}
+	for k, v := range map[string]string{
+		"client_name":      "web01",
+		"node_name":        "web01",
+		"chef_environment": "prod",
+		"policy_group":     "prod-group",
+		"platform":         "ubuntu",
+	} {
+		if resp.Auth.Metadata[k] != v {
+			t.Fatalf("metadata %s: expected %q, got %q", k, v, resp.Auth.Metadata[k])
+		}
+	}
+	if resp.Auth.Metadata["key_fingerprint"] != resp.Auth.InternalData["key_fingerprint"] {
+		t.Fatalf("unexpected key_fingerprint: %#v", resp.Auth.Metadata)
+	}
+
+	// A client without a node object can still log in with the default source
+	resp = login(web02)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("login without a node failed: %v", resp)
+	}
+	if _, ok := resp.Auth.Metadata["chef_environment"]; ok {
+		t.Fatalf("unexpected node metadata: %#v", resp.Auth.Metadata)
+	}
+
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.AliasSource = "node_id"
+	cfg.MetadataAttributes = []string{"automatic.fqdn", "normal.team", "automatic"}
+	cfg.DisplayNameTemplate = "{{chef_environment}}-{{automatic.fqdn}}"
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = login(web01)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v", resp)
+	}
+	if resp.Auth.Alias.Name != "6c3b7ea1-1d2f-4a4e-9f3e-0f1c2d3e4f5a" {
+		t.Fatalf("unexpected alias: %#v", resp.Auth.Alias)
+	}
+	if resp.Auth.DisplayName != "prod-web01.example.com" {
+		t.Fatalf("unexpected display name: %q", resp.Auth.DisplayName)
+	}
+	if resp.Auth.Metadata["automatic.fqdn"] != "web01.example.com" {
+		t.Fatalf("unexpected metadata: %#v", resp.Auth.Metadata)
+	}
+	// Missing and non-scalar attributes are left out
+	for _, k := range []string{"normal.team", "automatic"} {
+		if _, ok := resp.Auth.Metadata[k]; ok {
+			t.Fatalf("unexpected metadata %s: %#v", k, resp.Auth.Metadata)
+		}
+	}
+	if resp := login(web02); resp == nil || !resp.IsError() {
+		t.Fatalf("login without a node was allowed with alias_source node_id: %v", resp)
+	}
+
+	if org := organization("https://chef.example.com/organizations/acme"); org != "acme" {
+		t.Fatalf("unexpected organization: %q", org)
+	}
+	if org := organization(ts.URL); org != "" {
+		t.Fatalf("unexpected organization: %q", org)
+	}
+}
+
+func TestBackend_GroupAliases(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+			"policy_group":     "stable",
+			"automatic": map[string]interface{}{
+				"roles": []interface{}{"web", "base"},
+			},
+		},
+	}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+
+	login := func() *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      testLoginData(t, client),
+			Storage:   storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("login failed: %v %v", err, resp)
+		}
+		return resp
+	}
+	groupAliases := func(resp *logical.Response) []string {
+		var names []string
+		for _, a := range resp.Auth.GroupAliases {
+			names = append(names, a.Name)
+		}
+		return names
+	}
+
+	if names := groupAliases(login()); len(names) != 0 {
+		t.Fatalf("group aliases set without group_aliases: %v", names)
+	}
+
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.GroupAliases = true
+	cfg.GroupAliasEnvironmentPrefix = "env:"
+	cfg.GroupAliasRolePrefix = "role:"
+	cfg.GroupAliasPolicyGroupPrefix = "pg:"
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"env:prod", "role:web", "role:base", "pg:stable"}
+	if names := groupAliases(login()); !strutil.EquivalentSlices(names, expected) {
+		t.Fatalf("expected group aliases %v, got %v", expected, names)
+	}
+}
+
+func TestBackend_Servers(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	euObjects := map[string]interface{}{
+		"/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+		},
+		"/nodes/eu-db01": map[string]interface{}{
+			"name":             "eu-db01",
+			"chef_environment": "staging",
+		},
+	}
+	euTS := newTestChefServer(euObjects)
+	defer euTS.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	web01 := testChefClient(t, euObjects, euTS.URL, "web01")
+	db01 := testChefClient(t, euObjects, euTS.URL, "eu-db01")
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]map[string]interface{}{
+		"server/eu": {
+			"base_url":         euTS.URL,
+			"client_name":      "vault",
+			"client_key":       string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+			"default_policies": "eu-default",
+			"client_prefixes":  "eu-",
+		},
+		"client/eu:web01":     {"policies": "eu-web"},
+		"client/web01":        {"policies": "us-web"},
+		"environment/eu:prod": {"policies": "eu-prod"},
+		"environment/prod":    {"policies": "us-prod"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write %s: %v %v", path, err, resp)
+		}
+	}
+
+	login := func(client *config, server string) *logical.Response {
+		data := testLoginData(t, client)
+		data["server"] = server
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// The mappings of web01 and its environment on the eu server are separate
+	// from the ones on the server in the config
+	resp := login(web01, "eu")
+	if resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v", resp)
+	}
+	expected := []string{"default", "eu-default", "eu-web", "eu-prod"}
+	if !policyutil.EquivalentPolicies(resp.Auth.Policies, expected) {
+		t.Fatalf("expected policies %v, got %v", expected, resp.Auth.Policies)
+	}
+	if resp.Auth.Metadata["server"] != "eu" || resp.Auth.Metadata["client_name"] != "web01" {
+		t.Fatalf("unexpected metadata: %#v", resp.Auth.Metadata)
+	}
+
+	// web01 doesn't exist on the server in the config
+	if resp := login(web01, ""); resp == nil || !resp.IsError() {
+		t.Fatalf("login on the wrong server was allowed: %v", resp)
+	}
+	if resp := login(web01, "us"); resp == nil || !resp.IsError() {
+		t.Fatalf("login on an unknown server was allowed: %v", resp)
+	}
+
+	// eu-db01 is routed to the eu server by its prefix
+	resp = login(db01, "")
+	if resp == nil || resp.IsError() {
+		t.Fatalf("login by prefix failed: %v", resp)
+	}
+	if resp.Auth.InternalData["client_name"] != "eu:eu-db01" {
+		t.Fatalf("unexpected client: %#v", resp.Auth.InternalData)
+	}
+}
+
+func TestBackend_Organizations(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{
+		"/organizations/acme/nodes/web01": map[string]interface{}{
+			"name":             "web01",
+			"chef_environment": "prod",
+		},
+	}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL+"/organizations/acme", "web01")
+	for _, path := range []string{"/clients/web01/keys", "/clients/web01/keys/default"} {
+		objects["/organizations/acme"+path] = objects[path]
+		delete(objects, path)
+	}
+
+	for path, data := range map[string]map[string]interface{}{
+		"client/acme/web01":       {"policies": "acme-web"},
+		"client/web01":            {"policies": "web"},
+		"environment/acme/prod":   {"policies": "acme-prod"},
+		"environment/prod":        {"policies": "prod"},
+		"client_pattern/any":      {"pattern": "*", "policies": "any"},
+		"client_pattern/acme/web": {"pattern": "web*", "policies": "acme-pattern"},
+		"freeze/prod":             {"message": "frozen"},
+		"config":                  {"group_aliases": true, "alias_source": "node_name"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write %s: %v %v", path, err, resp)
+		}
+	}
+
+	login := func(org string) *logical.Response {
+		data := testLoginData(t, client)
+		data["organization"] = org
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := login("acme")
+	if resp == nil || resp.IsError() {
+		t.Fatalf("login failed: %v", resp)
+	}
+	// Only the environment mapping of the organization applies, and the
+	// freeze of the environment outside of it doesn't
+	expected := []string{"default", "acme-web", "acme-prod"}
+	if !policyutil.EquivalentPolicies(resp.Auth.Policies, expected) {
+		t.Fatalf("expected policies %v, got %v", expected, resp.Auth.Policies)
+	}
+	if len(resp.Auth.GroupAliases) != 1 || resp.Auth.GroupAliases[0].Name != "env:acme/prod" {
+		t.Fatalf("unexpected group aliases: %#v", resp.Auth.GroupAliases)
+	}
+	if resp.Auth.Alias.Name != "acme/web01" {
+		t.Fatalf("unexpected alias: %#v", resp.Auth.Alias)
+	}
+	if resp.Auth.Metadata["organization"] != "acme" || resp.Auth.Metadata["chef_environment"] != "prod" {
+		t.Fatalf("unexpected metadata: %#v", resp.Auth.Metadata)
+	}
+	if resp.Auth.InternalData["client_name"] != "acme/web01" {
+		t.Fatalf("unexpected client: %#v", resp.Auth.InternalData)
+	}
+
+	// The client only exists in the acme organization
+	if resp := login(""); resp == nil || !resp.IsError() {
+		t.Fatalf("login outside the organization was allowed: %v", resp)
+	}
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "clients/",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("couldn't list clients: %v %v", err, resp)
+	}
+	clients := resp.Data["keys"].([]string)
+	if !strutil.EquivalentSlices(clients, []string{"acme/web01", "web01"}) {
+		t.Fatalf("unexpected clients: %v", clients)
+	}
+
+	// Clients of an organization can have any name, including those of the
+	// endpoints that manage the versions and tokens of a client
+	for _, name := range []string{"acme/versions", "acme/rollback", "acme/tokens"} {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "client/" + name,
+			Data:      map[string]interface{}{"policies": "web"},
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write %s: %v %v", name, err, resp)
+		}
+		entry, err := b.Client(ctx, storage, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			t.Fatalf("mapping of %s wasn't written", name)
+		}
+	}
+
+	// Role bounds only match environments of the same organization
+	for role, allowed := range map[string]bool{
+		"prod":      false,
+		"acme/prod": true,
+	} {
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "role/" + role,
+			Data: map[string]interface{}{
+				"bound_environments": role,
+				"token_policies":     "deploy",
+			},
+			Storage: storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("couldn't write role %s: %v %v", role, err, resp)
+		}
+		data := testLoginData(t, client)
+		data["organization"] = "acme"
+		data["role"] = role
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp == nil || resp.IsError() == allowed {
+			t.Fatalf("unexpected response to a login with role %s: %v", role, resp)
+		}
+	}
+
+	for client, pattern := range map[string]string{
+		"acme/web02": "acme/web",
+		"acme/db01":  "",
+		"web02":      "any",
+	} {
+		name, _, err := b.matchClientPattern(ctx, storage, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != pattern {
+			t.Fatalf("expected %s to match pattern %q, got %q", client, pattern, name)
+		}
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "freeze/acme/prod",
+		Data:      map[string]interface{}{"message": "frozen"},
+		Storage:   storage,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't freeze acme/prod: %v %v", err, resp)
+	}
+	if resp := login("acme"); resp == nil || !resp.IsError() {
+		t.Fatalf("login in a frozen environment was allowed: %v", resp)
+	}
+
+	u, err := chefURL("https://chef.example.com/organizations/old/", "acme", "/nodes/web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.String() != "https://chef.example.com/organizations/acme/nodes/web01" {
+		t.Fatalf("unexpected URL: %s", u)
+	}
+}
+
+func TestBackend_EndpointFailover(t *testing.T) {
+	ctx := context.Background()
+	objects := map[string]interface{}{}
+	ts := newTestChefServer(objects)
+	defer ts.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	failures := 0
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	b, storage := testBackendWithChefServer(t, ts.URL)
+	client := testChefClient(t, objects, ts.URL, "web01")
+
+	cfg, err := b.Config(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BaseURL = dead.URL
+	cfg.FailoverURLs = []string{failing.URL, ts.URL}
+	cfg.EndpointCooldown = time.Minute
+	entry, err := logical.StorageEntryJSON("config", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func() {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "login",
+			Data:      testLoginData(t, client),
+			Storage:   storage,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("login failed: %v %v", err, resp)
+		}
+	}
+
+	login()
+	if failures != 1 {
+		t.Fatalf("expected 1 request to the failing endpoint, got %d", failures)
+	}
+	for _, e := range []string{dead.URL, failing.URL} {
+		if _, ok := b.endpointDown[e]; !ok {
+			t.Fatalf("endpoint %s wasn't marked down", e)
+		}
+	}
+
+	// Endpoints that failed are skipped during their cooldown
+	login()
+	if failures != 1 {
+		t.Fatalf("failing endpoint was retried during its cooldown")
+	}
+
+	// If every endpoint is down they are all tried again
+	b.endpointDown[ts.URL] = time.Now().Add(time.Minute)
+	login()
+	if _, ok := b.endpointDown[ts.URL]; ok {
+		t.Fatalf("endpoint that responded is still marked down")
+	}
+}
+
 // This is an acceptance test.
 // Requires the following env vars:
 // VAULT_CLIENT_NAME - name of the client vault should connect to server as
@@ -529,3 +2702,98 @@ func teardownTestNode(name string) error {
 	_, err = chefRequest("clients/"+name, "DELETE", []byte(""))
 	return err
 }
+
+// newTestChefServer starts a fake Chef server that answers GET requests for
+// the given paths with their JSON encoded objects.
+func newTestChefServer(objects map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obj, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(obj)
+	}))
+}
+
+// testBackendWithChefServer returns a backend configured to talk to the Chef
+// server at baseURL using a freshly generated client key.
+func testBackendWithChefServer(t *testing.T, baseURL string) (*backend, logical.Storage) {
+	ctx := context.Background()
+	config := logical.TestBackendConfig()
+	storage := &logical.InmemStorage{}
+	config.StorageView = storage
+	b := Backend()
+	if err := b.Setup(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"client_name": "vault",
+			"client_key":  string(keyPEM),
+			"base_url":    baseURL,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("couldn't configure backend: %v %v", err, resp)
+	}
+	return b, storage
+}
+
+// testChefClient registers a new key for the client with the test Chef server
+// and returns a config that signs requests as that client.
+func testChefClient(t *testing.T, objects map[string]interface{}, baseURL string, client string) *config {
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects["/clients/"+client+"/keys"] = []interface{}{
+		map[string]interface{}{
+			"uri":     baseURL + "/clients/" + client + "/keys/default",
+			"expired": false,
+		},
+	}
+	objects["/clients/"+client+"/keys/default"] = map[string]interface{}{
+		"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+
+	return &config{
+		ClientName: client,
+		ClientKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})),
+	}
+}
+
+// testLoginData returns the data of a login request signed as the client.
+func testLoginData(t *testing.T, client *config) map[string]interface{} {
+	loginURL, _ := url.Parse("http://localhost/v1/login")
+	headers, err := authHeaders(client, loginURL, "POST", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"client_name":       client.ClientName,
+		"signature_version": headers.Get("X-Ops-Sign"),
+		"signature":         headers.Get("X-Ops-Authorization"),
+		"timestamp":         headers.Get("X-Ops-Timestamp"),
+	}
+}
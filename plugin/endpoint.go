@@ -0,0 +1,60 @@
+package chefnode
+
+import (
+	"time"
+)
+
+// defaultEndpointCooldown is used when endpoint_cooldown isn't configured.
+const defaultEndpointCooldown = 30 * time.Second
+
+// endpoints returns the base URLs of the Chef server in the order they are
+// tried.
+func (c *config) endpoints() []string {
+	return append([]string{c.BaseURL}, c.FailoverURLs...)
+}
+
+func (c *config) endpointCooldown() time.Duration {
+	if c.EndpointCooldown <= 0 {
+		return defaultEndpointCooldown
+	}
+	return c.EndpointCooldown
+}
+
+// availableEndpoints returns the endpoints that haven't failed within their
+// cooldown, keeping their order. If every endpoint has failed recently they
+// are all returned, since refusing to try any would keep the server
+// unreachable until the cooldowns run out.
+func (b *backend) availableEndpoints(endpoints []string) []string {
+	b.endpointLock.Lock()
+	defer b.endpointLock.Unlock()
+
+	now := time.Now()
+	var available []string
+	for _, e := range endpoints {
+		if until, ok := b.endpointDown[e]; ok && now.Before(until) {
+			continue
+		}
+		available = append(available, e)
+	}
+	if len(available) == 0 {
+		return endpoints
+	}
+	return available
+}
+
+// markEndpointDown skips the endpoint for the cooldown period.
+func (b *backend) markEndpointDown(endpoint string, cooldown time.Duration) {
+	b.endpointLock.Lock()
+	defer b.endpointLock.Unlock()
+
+	b.endpointDown[endpoint] = time.Now().Add(cooldown)
+	b.Logger().Warn("chef-node: chef server endpoint failed, skipping it", "endpoint", endpoint, "cooldown", cooldown)
+}
+
+// markEndpointUp clears the failure of an endpoint that responded.
+func (b *backend) markEndpointUp(endpoint string) {
+	b.endpointLock.Lock()
+	defer b.endpointLock.Unlock()
+
+	delete(b.endpointDown, endpoint)
+}
@@ -0,0 +1,171 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// aliasSources maps each supported alias_source to the node attribute it is
+// read from. client_name isn't read from the node.
+var aliasSources = map[string]string{
+	"client_name": "",
+	"node_name":   "name",
+	"fqdn":        "automatic.fqdn",
+	"node_id":     "automatic.chef_guid",
+}
+
+// aliasError is returned when the alias of a token can't be determined from
+// the client's node.
+type aliasError struct {
+	client string
+	source string
+	reason string
+}
+
+func (e *aliasError) Error() string {
+	return fmt.Sprintf("couldn't determine %s of client %q for the identity alias: %s", e.source, e.client, e.reason)
+}
+
+// organization returns the name of the Chef organization in the base URL, or
+// an empty string if the URL doesn't refer to one.
+func organization(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "organizations" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// setAuthIdentity sets the identity alias of the token, its group aliases and
+// the metadata describing the client and its node, including the configured
+// metadata_attributes, and renders the display name. Node metadata and group
+// aliases are left out if the node object doesn't exist, unless the alias is
+// read from the node.
+func (b *backend) setAuthIdentity(ctx context.Context, req *logical.Request, auth *logical.Auth, client string, loader *nodeLoader, fingerprint string) error {
+	server, org, clientName := splitClient(client)
+	config, err := b.serverConfig(ctx, req.Storage, server)
+	if err != nil {
+		return err
+	}
+
+	auth.Metadata = map[string]string{
+		"client_name":     clientName,
+		"key_fingerprint": fingerprint,
+	}
+	if server != "" {
+		auth.Metadata["server"] = server
+	}
+	if org != "" {
+		auth.Metadata["organization"] = org
+	} else if baseOrg := organization(config.BaseURL); baseOrg != "" {
+		auth.Metadata["organization"] = baseOrg
+	}
+
+	source := config.AliasSource
+	if source == "" {
+		source = "client_name"
+	}
+
+	node, err := loader.get()
+	switch {
+	case err == nil:
+		auth.Metadata["node_name"] = node.Name
+		auth.Metadata["chef_environment"] = node.Environment
+		if node.PolicyGroup != "" {
+			auth.Metadata["policy_group"] = node.PolicyGroup
+		}
+		if v, ok := node.Attribute("automatic.platform"); ok {
+			auth.Metadata["platform"] = fmt.Sprint(v)
+		}
+		for _, path := range config.MetadataAttributes {
+			if v, ok := node.Attribute(path); ok {
+				if s, ok := scalarString(v); ok {
+					auth.Metadata[path] = s
+				}
+			}
+		}
+		if config.GroupAliases {
+			if err := setGroupAliases(config, auth, node, loader); err != nil {
+				return err
+			}
+		}
+	case !isNotFound(err):
+		return err
+	case source != "client_name":
+		return &aliasError{client: client, source: source, reason: "node not found"}
+	}
+
+	name := client
+	if path := aliasSources[source]; path != "" {
+		v, ok := node.Attribute(path)
+		s, isString := v.(string)
+		if !ok || !isString || s == "" {
+			return &aliasError{client: client, source: source, reason: fmt.Sprintf("attribute %q isn't set on the node", path)}
+		}
+		// Qualify the name like the client name, so that nodes of different
+		// servers and organizations don't share an entity
+		name = qualifyClient(server, org, s)
+	}
+	auth.Alias = &logical.Alias{
+		Name: name,
+	}
+
+	if config.DisplayNameTemplate != "" {
+		auth.DisplayName = b.displayName(config.DisplayNameTemplate, client, node)
+	}
+	return nil
+}
+
+// displayName renders the display name template against the node. The client
+// name is used if there is no node object or the template can't be rendered,
+// since a login shouldn't fail over the name its token is shown with.
+func (b *backend) displayName(tmpl string, client string, node *chefNode) string {
+	if node == nil {
+		return client
+	}
+	name, err := renderTemplate(tmpl, node)
+	if err != nil || name == "" {
+		b.Logger().Warn("couldn't render display_name_template, using the client name", "client", client, "error", err)
+		return client
+	}
+	return name
+}
+
+// setGroupAliases adds a group alias for the node's environment, for each of
+// its expanded roles and for its policy group. Each name is prefixed so that
+// external groups of different kinds can't collide, and qualified with the
+// node's server and organization the same way as client names.
+func setGroupAliases(config *config, auth *logical.Auth, node *chefNode, loader *nodeLoader) error {
+	roles, err := loader.roles()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	if node.Environment != "" {
+		names = append(names, config.GroupAliasEnvironmentPrefix+qualifyClient(node.server, node.org, node.Environment))
+	}
+	for _, role := range roles {
+		names = append(names, config.GroupAliasRolePrefix+qualifyClient(node.server, node.org, role))
+	}
+	if node.PolicyGroup != "" {
+		names = append(names, config.GroupAliasPolicyGroupPrefix+qualifyClient(node.server, node.org, node.PolicyGroup))
+	}
+
+	for _, name := range names {
+		auth.GroupAliases = append(auth.GroupAliases, &logical.Alias{
+			Name: name,
+		})
+	}
+	return nil
+}
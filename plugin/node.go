@@ -0,0 +1,462 @@
+package chefnode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// chefNode is the subset of a Chef node object that the backend uses to make
+// authorization decisions.
+type chefNode struct {
+	Name        string                 `json:"name"`
+	Environment string                 `json:"chef_environment"`
+	RunList     []string               `json:"run_list"`
+	PolicyName  string                 `json:"policy_name"`
+	PolicyGroup string                 `json:"policy_group"`
+	Automatic   map[string]interface{} `json:"automatic"`
+	Normal      map[string]interface{} `json:"normal"`
+	Default     map[string]interface{} `json:"default"`
+	Override    map[string]interface{} `json:"override"`
+
+	// server and org are the Chef server and organization the node was
+	// fetched from
+	server string
+	org    string
+}
+
+// Roles returns the names of the roles listed in the node's run list.
+func (n *chefNode) Roles() []string {
+	return runListRoles(n.RunList)
+}
+
+// runListRoles returns the names of the roles in a run list.
+func runListRoles(runList []string) []string {
+	var roles []string
+	for _, item := range runList {
+		if strings.HasPrefix(item, "role[") && strings.HasSuffix(item, "]") {
+			roles = append(roles, item[len("role["):len(item)-1])
+		}
+	}
+	return roles
+}
+
+// chefRole is the subset of a Chef role object needed to expand nested roles.
+type chefRole struct {
+	Name        string              `json:"name"`
+	RunList     []string            `json:"run_list"`
+	EnvRunLists map[string][]string `json:"env_run_lists"`
+}
+
+// runList returns the role's run list for the given environment.
+func (r *chefRole) runList(env string) []string {
+	if rl, ok := r.EnvRunLists[env]; ok {
+		return rl
+	}
+	return r.RunList
+}
+
+type cachedChefRole struct {
+	role    *chefRole
+	expires time.Time
+}
+
+const chefRoleCacheTTL = 5 * time.Minute
+
+// Attribute looks up a dotted attribute path on the node. The top level fields
+// name, chef_environment, policy_name and policy_group are accepted as is. Paths
+// prefixed with automatic, normal, default or override are looked up at that
+// precedence level and any other path is looked up in the merged attributes.
+func (n *chefNode) Attribute(path string) (interface{}, bool) {
+	switch path {
+	case "name":
+		return n.Name, true
+	case "chef_environment":
+		return n.Environment, true
+	case "policy_name":
+		return n.PolicyName, true
+	case "policy_group":
+		return n.PolicyGroup, true
+	}
+
+	parts := strings.Split(path, ".")
+	levels := map[string]map[string]interface{}{
+		"automatic": n.Automatic,
+		"override":  n.Override,
+		"normal":    n.Normal,
+		"default":   n.Default,
+	}
+	if attrs, ok := levels[parts[0]]; ok && len(parts) > 1 {
+		return lookupAttribute(attrs, parts[1:])
+	}
+
+	// Merged attributes, highest precedence first
+	for _, attrs := range []map[string]interface{}{n.Automatic, n.Override, n.Normal, n.Default} {
+		if v, ok := lookupAttribute(attrs, parts); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func lookupAttribute(attrs map[string]interface{}, parts []string) (interface{}, bool) {
+	var cur interface{} = attrs
+	for _, p := range parts {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[p]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+var templateRe = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// isTemplate reports whether s contains template placeholders.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// validateTemplate checks that every '{{' and '}}' in s is part of a well
+// formed placeholder.
+func validateTemplate(s string) error {
+	rest := templateRe.ReplaceAllString(s, "")
+	if strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return fmt.Errorf("malformed template %q", s)
+	}
+	return nil
+}
+
+// renderTemplate replaces each {{attribute.path}} placeholder in tmpl with the
+// value of that attribute on the node. Only string, number and boolean
+// attributes can be rendered.
+func renderTemplate(tmpl string, node *chefNode) (string, error) {
+	var renderErr error
+	out := templateRe.ReplaceAllStringFunc(tmpl, func(m string) string {
+		path := templateRe.FindStringSubmatch(m)[1]
+		v, ok := node.Attribute(path)
+		if !ok {
+			renderErr = fmt.Errorf("attribute %q not found on node", path)
+			return ""
+		}
+		s, ok := scalarString(v)
+		if !ok {
+			renderErr = fmt.Errorf("attribute %q is not a scalar value", path)
+		}
+		return s
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	return out, nil
+}
+
+// scalarString formats a string, number or boolean attribute value. It returns
+// false for any other value.
+func scalarString(v interface{}) (string, bool) {
+	switch v.(type) {
+	case string, float64, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+// renderedPolicyRe matches the names a templated policy may render to. Node
+// attributes can be set by the node itself, so anything that could be parsed
+// as more than one policy name, such as commas or whitespace, is rejected.
+var renderedPolicyRe = regexp.MustCompile(`^[a-z0-9_.\-/]+$`)
+
+// renderPolicies renders any templated policy names against the node. Policies
+// whose templates can't be rendered, or that render to an invalid policy name,
+// are dropped.
+func renderPolicies(policies []string, node *chefNode) []string {
+	var ret []string
+	for _, p := range policies {
+		if !isTemplate(p) {
+			ret = append(ret, p)
+			continue
+		}
+		if rendered, ok := renderPolicy(p, node); ok {
+			ret = append(ret, rendered)
+		}
+	}
+	return ret
+}
+
+// renderPolicy renders a templated policy name against the node. It returns
+// false if the template can't be rendered or renders to an invalid policy name.
+func renderPolicy(tmpl string, node *chefNode) (string, bool) {
+	rendered, err := renderTemplate(tmpl, node)
+	if err != nil {
+		return "", false
+	}
+	rendered = strings.ToLower(rendered)
+	if !renderedPolicyRe.MatchString(rendered) {
+		return "", false
+	}
+	return rendered, true
+}
+
+// validatePolicyTemplates checks every templated policy name in the list.
+func validatePolicyTemplates(policies []string) error {
+	for _, p := range policies {
+		if err := validateTemplate(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeLoader fetches a node object from the Chef server the first time it is
+// needed and remembers the result.
+type nodeLoader struct {
+	b    *backend
+	ctx  context.Context
+	req  *logical.Request
+	name string
+
+	loaded   bool
+	node     *chefNode
+	err      error
+	expanded []string
+}
+
+func (b *backend) nodeLoader(ctx context.Context, req *logical.Request, name string) *nodeLoader {
+	return &nodeLoader{
+		b:    b,
+		ctx:  ctx,
+		req:  req,
+		name: name,
+	}
+}
+
+func (l *nodeLoader) get() (*chefNode, error) {
+	if !l.loaded {
+		l.node, l.err = l.b.retrieveNode(l.ctx, l.req, l.name)
+		l.loaded = true
+	}
+	return l.node, l.err
+}
+
+// roles returns the node's fully expanded role list.
+func (l *nodeLoader) roles() ([]string, error) {
+	if l.expanded == nil {
+		node, err := l.get()
+		if err != nil {
+			return nil, err
+		}
+		roles, err := l.b.expandRoles(l.ctx, l.req, node)
+		if err != nil {
+			return nil, err
+		}
+		l.expanded = roles
+	}
+	return l.expanded, nil
+}
+
+// expandRoles returns every role applied to the node, including roles nested
+// in the run lists of other roles. The automatic roles attribute set by Ohai is
+// used when present, otherwise the role run lists are walked on the Chef server.
+func (b *backend) expandRoles(ctx context.Context, req *logical.Request, node *chefNode) ([]string, error) {
+	if raw, ok := node.Automatic["roles"].([]interface{}); ok {
+		roles := []string{}
+		for _, r := range raw {
+			if name, ok := r.(string); ok {
+				roles = append(roles, name)
+			}
+		}
+		return roles, nil
+	}
+
+	roles := []string{}
+	seen := make(map[string]bool)
+	queue := node.Roles()
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		roles = append(roles, name)
+
+		role, err := b.retrieveRole(ctx, req, node.server, node.org, name)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, runListRoles(role.runList(node.Environment))...)
+	}
+	return roles, nil
+}
+
+func (b *backend) retrieveRole(ctx context.Context, req *logical.Request, server string, org string, name string) (*chefRole, error) {
+	cacheKey := qualifyClient(server, org, name)
+	b.roleCacheLock.RLock()
+	cached, ok := b.roleCache[cacheKey]
+	b.roleCacheLock.RUnlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.role, nil
+	}
+
+	config, err := b.serverConfig(ctx, req.Storage, server)
+	if err != nil {
+		return nil, err
+	}
+
+	var role chefRole
+	if err := b.getChefObject(config, org, "/roles/"+name, &role); err != nil {
+		return nil, err
+	}
+
+	b.roleCacheLock.Lock()
+	b.roleCache[cacheKey] = &cachedChefRole{
+		role:    &role,
+		expires: time.Now().Add(chefRoleCacheTTL),
+	}
+	b.roleCacheLock.Unlock()
+
+	return &role, nil
+}
+
+func (b *backend) resetRoleCache() {
+	b.roleCacheLock.Lock()
+	b.roleCache = make(map[string]*cachedChefRole)
+	b.roleCacheLock.Unlock()
+}
+
+// retrieveNode fetches the node of the client from the client's Chef server.
+func (b *backend) retrieveNode(ctx context.Context, req *logical.Request, client string) (*chefNode, error) {
+	server, org, name := splitClient(client)
+	config, err := b.serverConfig(ctx, req.Storage, server)
+	if err != nil {
+		return nil, err
+	}
+
+	var node chefNode
+	if err := b.getChefObject(config, org, "/nodes/"+name, &node); err != nil {
+		return nil, err
+	}
+	node.server = server
+	node.org = org
+	return &node, nil
+}
+
+// chefStatusError is returned when the Chef server responds with a status
+// other than 200.
+type chefStatusError struct {
+	status int
+	path   string
+}
+
+func (e *chefStatusError) Error() string {
+	return fmt.Sprintf("chef server returned %d for %s", e.status, e.path)
+}
+
+// isNotFound returns whether err is a 404 response from the Chef server.
+func isNotFound(err error) bool {
+	e, ok := err.(*chefStatusError)
+	return ok && e.status == http.StatusNotFound
+}
+
+// chefRequestTimeout bounds each request to a Chef server endpoint, so that an
+// endpoint that hangs fails over like one that refuses connections.
+const chefRequestTimeout = 10 * time.Second
+
+// endpointError is returned when a Chef server endpoint can't be reached.
+type endpointError struct {
+	endpoint string
+	err      error
+}
+
+func (e *endpointError) Error() string {
+	return fmt.Sprintf("chef server endpoint %s failed: %s", e.endpoint, e.err)
+}
+
+// isEndpointFailure returns whether err means the endpoint is unavailable and
+// the next one should be tried.
+func isEndpointFailure(err error) bool {
+	switch e := err.(type) {
+	case *endpointError:
+		return true
+	case *chefStatusError:
+		return e.status >= http.StatusInternalServerError
+	}
+	return false
+}
+
+// getChefObject performs a signed GET request of an API path against the Chef
+// server and decodes the JSON response into v. The path is placed under the
+// organization if one is given. The endpoints of the server are tried in order
+// until one of them responds without a connection error, timeout or 5xx status.
+func (b *backend) getChefObject(conf *config, org string, path string, v interface{}) error {
+	var err error
+	for _, endpoint := range b.availableEndpoints(conf.endpoints()) {
+		var u *url.URL
+		u, err = chefURL(endpoint, org, path)
+		if err != nil {
+			return err
+		}
+
+		var body []byte
+		body, err = chefGet(conf, endpoint, u)
+		if isEndpointFailure(err) {
+			b.markEndpointDown(endpoint, conf.endpointCooldown())
+			continue
+		}
+		b.markEndpointUp(endpoint)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, v); err != nil {
+			return fmt.Errorf("Couldn't unmarshal '%s': %s", body, err)
+		}
+		return nil
+	}
+	return err
+}
+
+// chefGet performs a signed GET request against a single endpoint and returns
+// the body of a successful response.
+func chefGet(conf *config, endpoint string, u *url.URL) ([]byte, error) {
+	headers, err := authHeaders(conf, u, "GET", nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	chefReq, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	chefReq.Header = headers
+
+	client := &http.Client{
+		Timeout: chefRequestTimeout,
+	}
+	resp, err := client.Do(chefReq)
+	if err != nil {
+		return nil, &endpointError{endpoint: endpoint, err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &endpointError{endpoint: endpoint, err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &chefStatusError{status: resp.StatusCode, path: u.Path}
+	}
+	return body, nil
+}
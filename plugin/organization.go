@@ -0,0 +1,107 @@
+package chefnode
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// qualifyClient returns the name that the mappings and state of a client are
+// stored under, which is the client name prefixed with its organization and
+// with its server if it isn't the server in the config, as in
+// "<server>:<org>/<client>". Chef client and organization names can't contain
+// ':' or '/', so the names of clients of different servers and organizations
+// can't collide.
+func qualifyClient(server string, org string, client string) string {
+	name := client
+	if org != "" {
+		name = org + "/" + name
+	}
+	if server != "" {
+		name = server + ":" + name
+	}
+	return name
+}
+
+// splitClient returns the server, organization and Chef client name of a
+// qualified client name.
+func splitClient(name string) (string, string, string) {
+	server := ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		server, name = name[:i], name[i+1:]
+	}
+	org := ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		org, name = name[:i], name[i+1:]
+	}
+	return server, org, name
+}
+
+// chefURL returns the URL of an API path on a Chef server endpoint. If an
+// organization is given the path is placed under it, replacing any
+// organization the base URL already points at.
+func chefURL(baseURL string, org string, path string) (*url.URL, error) {
+	base := strings.TrimSuffix(baseURL, "/")
+	if org != "" {
+		if i := strings.Index(base, "/organizations/"); i >= 0 {
+			base = base[:i]
+		}
+		base += "/organizations/" + org
+	}
+	return url.Parse(base + path)
+}
+
+// listClients lists the qualified names stored under prefix, such as those of
+// clients or of environment mappings. Names in an organization are stored one
+// level down, so each organization is listed as well.
+func listClients(ctx context.Context, s logical.Storage, prefix string) ([]string, error) {
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/") {
+			names = append(names, k)
+			continue
+		}
+		sub, err := s.List(ctx, prefix+k)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range sub {
+			if !strings.HasSuffix(n, "/") {
+				names = append(names, k+n)
+			}
+		}
+	}
+	return names, nil
+}
+
+// listScope lists the names stored under prefix that belong to the scope of a
+// server and organization, as returned by qualifyClient(server, org, ""),
+// without the scope. Scopes without an organization aren't a level of their
+// own, so they are filtered from the names under prefix.
+func listScope(ctx context.Context, s logical.Storage, prefix string, scope string) ([]string, error) {
+	if strings.HasSuffix(scope, "/") {
+		prefix, scope = prefix+scope, ""
+	}
+	keys, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, k := range keys {
+		if strings.HasSuffix(k, "/") || !strings.HasPrefix(k, scope) {
+			continue
+		}
+		if name := strings.TrimPrefix(k, scope); !strings.Contains(name, ":") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,155 @@
+package chefnode
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathChefRolesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "chef_roles/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathChefRoleList,
+		},
+		HelpSynopsis:    pathChefRoleHelpSyn,
+		HelpDescription: pathChefRoleHelpDesc,
+	}
+}
+
+func pathChefRoles(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `chef_role/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef role, qualified as <server>:<organization>/<role> for a named Chef server or an organization",
+			},
+			"policies": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Comma-seperated list of policies associated to nodes with this Chef role",
+			},
+			"denied_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of policies removed from the final policy set
+of nodes with this Chef role, regardless of which mapping granted them.`,
+			},
+			"deny_login": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, nodes with this Chef role are not allowed to log in.",
+			},
+			"preview": previewSchema,
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathChefRoleDelete,
+			logical.ReadOperation:   b.pathChefRoleRead,
+			logical.UpdateOperation: b.previewable(b.pathChefRoleWrite),
+		},
+		HelpSynopsis:    pathChefRoleHelpSyn,
+		HelpDescription: pathChefRoleHelpDesc,
+	}
+}
+
+func (b *backend) pathChefRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roles, err := listClients(ctx, req.Storage, "chef_role/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(roles), nil
+}
+
+func (b *backend) ChefRole(ctx context.Context, s logical.Storage, n string) (*ChefRoleEntry, error) {
+	entry, err := s.Get(ctx, "chef_role/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ChefRoleEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathChefRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+
+	err := req.Storage.Delete(ctx, "chef_role/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathChefRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.ChefRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"policies":        role.Policies,
+			"denied_policies": role.DeniedPolicies,
+			"deny_login":      role.DenyLogin,
+		},
+	}, nil
+}
+
+func (b *backend) pathChefRoleWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role := &ChefRoleEntry{
+		Policies:       policyutil.ParsePolicies(d.Get("policies").(string)),
+		DeniedPolicies: policyutil.ParsePolicies(d.Get("denied_policies").(string)),
+		DenyLogin:      d.Get("deny_login").(bool),
+	}
+
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateMapping(role.Policies, role.DeniedPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+
+	entry, err := logical.StorageEntryJSON("chef_role/"+d.Get("name").(string), role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type ChefRoleEntry struct {
+	Policies       []string
+	DeniedPolicies []string
+	DenyLogin      bool
+}
+
+const pathChefRoleHelpSyn = `
+Manage Vault policies assigned to nodes with a Chef role
+`
+const pathChefRoleHelpDesc = `
+This endpoint allows you to create, read, update, and delete configuration for policies
+associated with Chef roles. Roles are matched against the node's fully expanded role
+list, so a role included by another role in the run list also applies. A role can also
+deny policies granted by other mappings, or block login for all of its nodes. The
+mappings of a role of a named Chef server or of an organization are written to
+chef_role/<server>:<organization>/<role> and only apply to its nodes.
+`
@@ -2,6 +2,9 @@ package chefnode
 
 import (
 	"context"
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/vault/helper/policyutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -27,24 +30,100 @@ func pathClients(b *backend) *framework.Path {
 				Description: "Name of the Chef client",
 			},
 			"policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of policies associated to this Chef client.
+Policy names may contain templates such as {{chef_environment}} or {{normal.team}}
+that are rendered against the node object at login. Nodes can set most of their own
+attributes, so a template lets a node choose part of its policy name.`,
+			},
+			"denied_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of policies removed from the final policy set
+of this Chef client, regardless of which mapping granted them.`,
+			},
+			"deny_login": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, this Chef client is not allowed to log in.",
+			},
+			"description": &framework.FieldSchema{
 				Type:        framework.TypeString,
-				Description: "Comma-seperated list of policies associated to this Chef client",
+				Description: "Description of the mapping",
+			},
+			"owner": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Owner of the Chef client, for example a team name",
+			},
+			"expires_at": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `RFC 3339 timestamp after which the mapping stops applying. If empty,
+the mapping doesn't expire.`,
 			},
+			"disabled": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, this Chef client is not allowed to log in, even after the mapping expires.",
+			},
+			"max_active_tokens": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `Maximum number of active tokens this Chef client can have. If 0,
+the mount's max_active_tokens applies.`,
+			},
+			"key_fingerprint": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Fingerprint of the only key this Chef client may log in with. It is set
+when a pending client is approved and kept by writes that don't include it. If empty,
+any of the client's keys is accepted.`,
+			},
+			"cas": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `If set, the write only succeeds if the current version of the
+mapping matches. Use 0 to only write the mapping if it doesn't exist yet.`,
+			},
+			"preview": previewSchema,
 		},
+		ExistenceCheck: b.pathClientExistenceCheck,
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.DeleteOperation: b.pathClientDelete,
 			logical.ReadOperation:   b.pathClientRead,
-			logical.UpdateOperation: b.pathClientWrite,
+			logical.CreateOperation: b.previewable(b.pathClientWrite),
+			logical.UpdateOperation: b.previewable(b.pathClientWrite),
 		},
+		HelpSynopsis:    pathClientHelpSyn,
+		HelpDescription: pathClientHelpDesc,
 	}
 }
 
+func (b *backend) pathClientExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	client, err := b.Client(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return client != nil, nil
+}
+
 func (b *backend) pathClientList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	clients, err := req.Storage.List(ctx, "client/")
+	clients, err := listClients(ctx, req.Storage, "client/")
 	if err != nil {
 		return nil, err
 	}
-	return logical.ListResponse(clients), nil
+
+	keyInfo := make(map[string]interface{})
+	for _, name := range clients {
+		client, err := b.Client(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if client == nil {
+			continue
+		}
+		keyInfo[name] = map[string]interface{}{
+			"policies":    client.Policies,
+			"description": client.Description,
+			"owner":       client.Owner,
+			"expires_at":  client.expiresAt(),
+			"disabled":    client.Disabled,
+		}
+	}
+	return logical.ListResponseWithInfo(clients, keyInfo), nil
 }
 
 func (b *backend) Client(ctx context.Context, s logical.Storage, n string) (*ClientEntry, error) {
@@ -60,19 +139,44 @@ func (b *backend) Client(ctx context.Context, s logical.Storage, n string) (*Cli
 	if err := entry.DecodeJSON(&result); err != nil {
 		return nil, err
 	}
+	// Mappings written before they were versioned are their first version
+	if result.Version < 1 {
+		result.Version = 1
+	}
 
 	return &result, nil
 }
 
 func (b *backend) pathClientDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	err := req.Storage.Delete(ctx, "client/"+d.Get("name").(string))
-	if err != nil {
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if err := b.deleteClient(ctx, req.Storage, d.Get("name").(string)); err != nil {
 		return nil, err
 	}
 
 	return nil, nil
 }
 
+// deleteClient deletes the client mapping along with its version history. The
+// caller must hold clientLock.
+func (b *backend) deleteClient(ctx context.Context, s logical.Storage, name string) error {
+	if err := s.Delete(ctx, "client/"+name); err != nil {
+		return err
+	}
+
+	versions, err := s.List(ctx, "client_version/"+name+"/")
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err := s.Delete(ctx, "client_version/"+name+"/"+v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *backend) pathClientRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	client, err := b.Client(ctx, req.Storage, d.Get("name").(string))
 	if err != nil {
@@ -84,27 +188,109 @@ func (b *backend) pathClientRead(ctx context.Context, req *logical.Request, d *f
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"policies": client.Policies,
+			"policies":          client.Policies,
+			"denied_policies":   client.DeniedPolicies,
+			"deny_login":        client.DenyLogin,
+			"description":       client.Description,
+			"owner":             client.Owner,
+			"expires_at":        client.expiresAt(),
+			"disabled":          client.Disabled,
+			"max_active_tokens": client.MaxActiveTokens,
+			"key_fingerprint":   client.KeyFingerprint,
+			"version":           client.Version,
 		},
 	}, nil
 }
 
 func (b *backend) pathClientWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	entry, err := logical.StorageEntryJSON("client/"+d.Get("name").(string), &ClientEntry{
-		Policies: policyutil.ParsePolicies(d.Get("policies").(string)),
-	})
+	client := &ClientEntry{
+		Policies:        policyutil.ParsePolicies(d.Get("policies").(string)),
+		DeniedPolicies:  policyutil.ParsePolicies(d.Get("denied_policies").(string)),
+		DenyLogin:       d.Get("deny_login").(bool),
+		Description:     d.Get("description").(string),
+		Owner:           d.Get("owner").(string),
+		Disabled:        d.Get("disabled").(bool),
+		MaxActiveTokens: d.Get("max_active_tokens").(int),
+	}
+	if client.MaxActiveTokens < 0 {
+		return logical.ErrorResponse("max_active_tokens can't be negative"), nil
+	}
+	if raw := d.Get("expires_at").(string); raw != "" {
+		expiresAt, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("couldn't parse expires_at: %s", err)), nil
+		}
+		client.ExpiresAt = expiresAt.UTC()
+	}
+
+	cfg, err := b.Config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if err := cfg.validateMapping(client.Policies, client.DeniedPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var cas *int
+	if raw, ok := d.GetOk("cas"); ok {
+		v := raw.(int)
+		cas = &v
+	}
+
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	if raw, ok := d.GetOk("key_fingerprint"); ok {
+		client.KeyFingerprint = raw.(string)
+	} else {
+		existing, err := b.Client(ctx, req.Storage, d.Get("name").(string))
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			client.KeyFingerprint = existing.KeyFingerprint
+		}
+	}
+
+	version, err := b.putClientVersion(ctx, req.Storage, d.Get("name").(string), client, cas)
+	if err != nil {
+		if _, ok := err.(*casError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 		return nil, err
 	}
 
-	return nil, nil
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": version,
+		},
+	}, nil
 }
 
 type ClientEntry struct {
-	Policies []string
+	Policies        []string
+	DeniedPolicies  []string
+	DenyLogin       bool
+	Description     string
+	Owner           string
+	ExpiresAt       time.Time
+	Disabled        bool
+	MaxActiveTokens int
+	KeyFingerprint  string
+	Version         int
+}
+
+// expired returns whether the mapping has stopped applying at the given time.
+func (c *ClientEntry) expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt)
+}
+
+// expiresAt returns the expiry of the mapping formatted for responses.
+func (c *ClientEntry) expiresAt() string {
+	if c.ExpiresAt.IsZero() {
+		return ""
+	}
+	return c.ExpiresAt.Format(time.RFC3339)
 }
 
 const pathClientHelpSyn = `
@@ -0,0 +1,245 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathClientPatternsList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "client_patterns/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathClientPatternList,
+		},
+		HelpSynopsis:    pathClientPatternHelpSyn,
+		HelpDescription: pathClientPatternHelpDesc,
+	}
+}
+
+func pathClientPatterns(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `client_pattern/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the client pattern mapping",
+			},
+			"pattern": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Glob or regular expression matched against the Chef client name",
+			},
+			"pattern_type": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Default:     "glob",
+				Description: `Type of the pattern, either "glob" or "regex". Regular expressions must match the whole client name.`,
+			},
+			"priority": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `Precedence of this mapping when several patterns match a client.
+The matching pattern with the lowest priority applies, ties are broken by name.`,
+			},
+			"policies": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Comma-seperated list of policies associated to matching Chef clients",
+			},
+			"denied_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of policies removed from the final policy set
+of matching Chef clients, regardless of which mapping granted them.`,
+			},
+			"deny_login": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, matching Chef clients are not allowed to log in.",
+			},
+			"preview": previewSchema,
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathClientPatternDelete,
+			logical.ReadOperation:   b.pathClientPatternRead,
+			logical.UpdateOperation: b.previewable(b.pathClientPatternWrite),
+		},
+		HelpSynopsis:    pathClientPatternHelpSyn,
+		HelpDescription: pathClientPatternHelpDesc,
+	}
+}
+
+func (b *backend) pathClientPatternList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	patterns, err := listClients(ctx, req.Storage, "client_pattern/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(patterns), nil
+}
+
+func (b *backend) ClientPattern(ctx context.Context, s logical.Storage, n string) (*ClientPatternEntry, error) {
+	entry, err := s.Get(ctx, "client_pattern/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ClientPatternEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// matchClientPattern returns the name and entry of the highest precedence
+// pattern mapping that matches the client, or nil if none match. Only the
+// patterns of the client's server and organization are matched, against the
+// client name without them.
+func (b *backend) matchClientPattern(ctx context.Context, s logical.Storage, client string) (string, *ClientPatternEntry, error) {
+	server, org, clientName := splitClient(client)
+	scope := qualifyClient(server, org, "")
+	names, err := listScope(ctx, s, "client_pattern/", scope)
+	if err != nil {
+		return "", nil, err
+	}
+	sort.Strings(names)
+
+	var matchName string
+	var match *ClientPatternEntry
+	for _, name := range names {
+		name = scope + name
+		entry, err := b.ClientPattern(ctx, s, name)
+		if err != nil {
+			return "", nil, err
+		}
+		if entry == nil || !entry.matches(clientName) {
+			continue
+		}
+		if match == nil || entry.Priority < match.Priority {
+			matchName = name
+			match = entry
+		}
+	}
+	return matchName, match, nil
+}
+
+func (b *backend) pathClientPatternDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+
+	err := req.Storage.Delete(ctx, "client_pattern/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathClientPatternRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	pattern, err := b.ClientPattern(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if pattern == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"pattern":         pattern.Pattern,
+			"pattern_type":    pattern.PatternType,
+			"priority":        pattern.Priority,
+			"policies":        pattern.Policies,
+			"denied_policies": pattern.DeniedPolicies,
+			"deny_login":      pattern.DenyLogin,
+		},
+	}, nil
+}
+
+func (b *backend) pathClientPatternWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	pattern := &ClientPatternEntry{
+		Pattern:        d.Get("pattern").(string),
+		PatternType:    d.Get("pattern_type").(string),
+		Priority:       d.Get("priority").(int),
+		Policies:       policyutil.ParsePolicies(d.Get("policies").(string)),
+		DeniedPolicies: policyutil.ParsePolicies(d.Get("denied_policies").(string)),
+		DenyLogin:      d.Get("deny_login").(bool),
+	}
+	if err := pattern.validate(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateMapping(pattern.Policies, pattern.DeniedPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+
+	entry, err := logical.StorageEntryJSON("client_pattern/"+d.Get("name").(string), pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (e *ClientPatternEntry) validate() error {
+	if e.Pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	switch e.PatternType {
+	case "glob":
+	case "regex":
+		if _, err := regexp.Compile(e.Pattern); err != nil {
+			return fmt.Errorf("invalid regex: %s", err)
+		}
+	default:
+		return fmt.Errorf(`pattern_type must be "glob" or "regex"`)
+	}
+	return nil
+}
+
+// matches reports whether the client name matches the entry's pattern.
+func (e *ClientPatternEntry) matches(client string) bool {
+	if e.PatternType == "regex" {
+		re, err := regexp.Compile("^(?:" + e.Pattern + ")$")
+		if err != nil {
+			return false
+		}
+		return re.MatchString(client)
+	}
+	return strutil.StrListContainsGlob([]string{e.Pattern}, client)
+}
+
+type ClientPatternEntry struct {
+	Pattern        string
+	PatternType    string
+	Priority       int
+	Policies       []string
+	DeniedPolicies []string
+	DenyLogin      bool
+}
+
+const pathClientPatternHelpSyn = `
+Manage Vault policies assigned to Chef clients by name pattern
+`
+const pathClientPatternHelpDesc = `
+This endpoint allows you to create, read, update, and delete policy mappings that
+match Chef client names with a glob or regular expression. A pattern mapping is only
+used for clients that have no exact 'client/<name>' mapping. When several patterns
+match a client, the one with the lowest priority applies, with ties broken by name.
+Patterns written to client_pattern/<server>:<organization>/<name> only apply to clients
+of that server and organization, and are matched against the client name without them.
+`
@@ -0,0 +1,350 @@
+package chefnode
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathClientTokens(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `client_tokens/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathClientTokensDelete,
+			logical.ReadOperation:   b.pathClientTokensRead,
+		},
+		HelpSynopsis:    pathClientTokensHelpSyn,
+		HelpDescription: pathClientTokensHelpDesc,
+	}
+}
+
+// The token ID is always the last segment, since client names of an
+// organization contain a '/'.
+func pathClientToken(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `client_token/(?P<name>.+)/(?P<token_id>[^/]+)$`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client",
+			},
+			"token_id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "ID of the token record",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathClientTokenDelete,
+		},
+		HelpSynopsis:    pathClientTokensHelpSyn,
+		HelpDescription: pathClientTokensHelpDesc,
+	}
+}
+
+// activeTokenEntry is a token issued to a client by login. Vault doesn't tell
+// auth backends when a token is revoked, so a token is considered active until
+// its TTL runs out, and renewals move its expiry forward.
+type activeTokenEntry struct {
+	Role      string    `json:"role"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tokenLimitError is returned when a client already has the maximum number of
+// active tokens.
+type tokenLimitError struct {
+	client string
+	limit  int
+}
+
+func (e *tokenLimitError) Error() string {
+	return fmt.Sprintf("client %q has reached the limit of %d active tokens", e.client, e.limit)
+}
+
+// maxActiveTokens returns the limit of active tokens for the client. The
+// client mapping's limit takes precedence over the mount's.
+func (b *backend) maxActiveTokens(ctx context.Context, s logical.Storage, client string) (int, error) {
+	entry, err := b.Client(ctx, s, client)
+	if err != nil {
+		return 0, err
+	}
+	if entry != nil && entry.MaxActiveTokens > 0 {
+		return entry.MaxActiveTokens, nil
+	}
+	config, err := b.Config(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	return config.MaxActiveTokens, nil
+}
+
+// activeTokens returns the client's tokens that haven't expired, and deletes
+// the records of the ones that have.
+func (b *backend) activeTokens(ctx context.Context, s logical.Storage, client string) (map[string]*activeTokenEntry, error) {
+	ids, err := s.List(ctx, "token/"+client+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tokens := make(map[string]*activeTokenEntry)
+	for _, id := range ids {
+		// Skip the tokens of clients in an organization of the same name
+		if strings.HasSuffix(id, "/") {
+			continue
+		}
+		key := "token/" + client + "/" + id
+		entry, err := s.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		var token activeTokenEntry
+		if err := entry.DecodeJSON(&token); err != nil {
+			return nil, err
+		}
+		if now.After(token.ExpiresAt) {
+			if err := s.Delete(ctx, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		tokens[id] = &token
+	}
+	return tokens, nil
+}
+
+// checkTokenLimit returns a tokenLimitError if the client already has the
+// maximum number of active tokens.
+func (b *backend) checkTokenLimit(ctx context.Context, s logical.Storage, client string) error {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	return b.checkTokenLimitLocked(ctx, s, client)
+}
+
+// checkTokenLimitLocked is checkTokenLimit for callers holding tokenLock. The
+// client's tokens are only listed if it has a limit.
+func (b *backend) checkTokenLimitLocked(ctx context.Context, s logical.Storage, client string) error {
+	limit, err := b.maxActiveTokens(ctx, s, client)
+	if err != nil {
+		return err
+	}
+	if limit <= 0 {
+		return nil
+	}
+	tokens, err := b.activeTokens(ctx, s, client)
+	if err != nil {
+		return err
+	}
+	if len(tokens) >= limit {
+		return &tokenLimitError{client: client, limit: limit}
+	}
+	return nil
+}
+
+// trackToken records the token that is about to be issued. It is the last step
+// of a login, so that a login refused by any other check leaves no record. The
+// limit is checked again since another login of the client may have been
+// recorded after checkTokenLimit. The ID of the record is stored in the token's
+// internal data so that renewals can update it.
+func (b *backend) trackToken(ctx context.Context, req *logical.Request, client string, auth *logical.Auth) error {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	if err := b.checkTokenLimitLocked(ctx, req.Storage, client); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	ttl, _, err := framework.CalculateTTL(b.System(), 0, auth.TTL, 0, auth.MaxTTL, 0, now)
+	if err != nil {
+		return err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(raw)
+
+	role, _ := auth.InternalData["role"].(string)
+	entry, err := logical.StorageEntryJSON("token/"+client+"/"+id, &activeTokenEntry{
+		Role:      role,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return err
+	}
+	auth.InternalData["token_id"] = id
+	return nil
+}
+
+// trackRenewal moves the expiry of the renewed token forward. Tokens issued
+// before tracking was added have no record and are skipped.
+func (b *backend) trackRenewal(ctx context.Context, req *logical.Request, client string, resp *logical.Response) error {
+	id, ok := req.Auth.InternalData["token_id"].(string)
+	if !ok || resp == nil || resp.Auth == nil {
+		return nil
+	}
+
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	key := "token/" + client + "/" + id
+	entry, err := req.Storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return nil
+	}
+	var token activeTokenEntry
+	if err := entry.DecodeJSON(&token); err != nil {
+		return err
+	}
+
+	ttl, _, err := framework.CalculateTTL(b.System(), req.Auth.Increment, resp.Auth.TTL, 0, resp.Auth.MaxTTL, 0, token.IssuedAt)
+	if err != nil {
+		return err
+	}
+	token.ExpiresAt = time.Now().UTC().Add(ttl)
+
+	entry, err = logical.StorageEntryJSON(key, &token)
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
+
+// pruneTokens deletes the records of every expired token. Records of tokens
+// that were revoked before they expired can't be pruned: Vault doesn't notify
+// the backend of revocations and offers it no way to look a token up, so they
+// stay until their expiry or until they are deleted through client_tokens/<name>.
+func (b *backend) pruneTokens(ctx context.Context, s logical.Storage) error {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	return b.pruneTokensUnder(ctx, s, "")
+}
+
+// pruneTokensUnder prunes the tokens of every client whose qualified name
+// starts with prefix. The tokens of clients in an organization are stored
+// below a directory named after the organization, which may also hold the
+// tokens of a client of the same name.
+func (b *backend) pruneTokensUnder(ctx context.Context, s logical.Storage, prefix string) error {
+	dirs, err := s.List(ctx, "token/"+prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if !strings.HasSuffix(d, "/") {
+			continue
+		}
+		client := prefix + strings.TrimSuffix(d, "/")
+		if _, err := b.activeTokens(ctx, s, client); err != nil {
+			return err
+		}
+		if err := b.pruneTokensUnder(ctx, s, client+"/"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathClientTokensRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client := d.Get("name").(string)
+
+	b.tokenLock.Lock()
+	tokens, err := b.activeTokens(ctx, req.Storage, client)
+	b.tokenLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	limit, err := b.maxActiveTokens(ctx, req.Storage, client)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{})
+	for id, token := range tokens {
+		data[id] = map[string]interface{}{
+			"role":       token.Role,
+			"issued_at":  token.IssuedAt.Format(time.RFC3339),
+			"expires_at": token.ExpiresAt.Format(time.RFC3339),
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"tokens":            data,
+			"active_tokens":     len(tokens),
+			"max_active_tokens": limit,
+		},
+	}, nil
+}
+
+func (b *backend) pathClientTokensDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client := d.Get("name").(string)
+
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	ids, err := req.Storage.List(ctx, "token/"+client+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		// Leave the tokens of clients in an organization of the same name
+		if strings.HasSuffix(id, "/") {
+			continue
+		}
+		if err := req.Storage.Delete(ctx, "token/"+client+"/"+id); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (b *backend) pathClientTokenDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	err := req.Storage.Delete(ctx, "token/"+d.Get("name").(string)+"/"+d.Get("token_id").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+const pathClientTokensHelpSyn = `
+List or forget the active tokens issued to a Chef client
+`
+const pathClientTokensHelpDesc = `
+Returns the tokens issued to the client that haven't expired, along with the limit of
+active tokens that applies to it. Vault doesn't notify the backend when a token is
+revoked, so a revoked token is listed, and counts towards max_active_tokens, until its
+TTL would have run out. Deleting client_tokens/<name> forgets the records of all of the
+client's tokens, and deleting client_token/<name>/<token_id> forgets only that one,
+after the tokens have been revoked in Vault. It doesn't revoke the tokens themselves.
+`
@@ -0,0 +1,292 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// clientVersionHistory is the number of previous versions kept for every
+// client mapping.
+const clientVersionHistory = 10
+
+func pathClientVersions(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `client_versions/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathClientVersionsRead,
+		},
+		HelpSynopsis:    pathClientVersionsHelpSyn,
+		HelpDescription: pathClientVersionsHelpDesc,
+	}
+}
+
+func pathClientRollback(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `client_rollback/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client",
+			},
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Version of the mapping to restore",
+			},
+			"cas": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `If set, the rollback only succeeds if the current version of the
+mapping matches.`,
+			},
+			"preview": previewSchema,
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.previewable(b.pathClientRollback),
+		},
+		HelpSynopsis:    pathClientRollbackHelpSyn,
+		HelpDescription: pathClientRollbackHelpDesc,
+	}
+}
+
+// casError is returned when a check-and-set write doesn't match the current
+// version of a mapping.
+type casError struct {
+	name    string
+	current int
+	cas     int
+}
+
+func (e *casError) Error() string {
+	return fmt.Sprintf("check-and-set parameter did not match the current version of client %q: cas is %d, current version is %d", e.name, e.cas, e.current)
+}
+
+// putClientVersion stores client as the next version of the named mapping and
+// moves the current version into the history. If cas is set, it must match the
+// current version, which is 0 if the mapping doesn't exist.
+func (b *backend) putClientVersion(ctx context.Context, s logical.Storage, name string, client *ClientEntry, cas *int) (int, error) {
+	existing, err := b.Client(ctx, s, name)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	if existing != nil {
+		current = existing.Version
+	}
+	if cas != nil && *cas != current {
+		return 0, &casError{name: name, current: current, cas: *cas}
+	}
+
+	if existing != nil {
+		entry, err := logical.StorageEntryJSON(fmt.Sprintf("client_version/%s/%d", name, current), existing)
+		if err != nil {
+			return 0, err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return 0, err
+		}
+		if err := pruneClientVersions(ctx, s, name); err != nil {
+			return 0, err
+		}
+	}
+
+	client.Version = current + 1
+	entry, err := logical.StorageEntryJSON("client/"+name, client)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return 0, err
+	}
+	return client.Version, nil
+}
+
+// clientVersions returns the versions in the history of the named mapping,
+// oldest first.
+func clientVersions(ctx context.Context, s logical.Storage, name string) ([]int, error) {
+	keys, err := s.List(ctx, "client_version/"+name+"/")
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, k := range keys {
+		v, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+func pruneClientVersions(ctx context.Context, s logical.Storage, name string) error {
+	versions, err := clientVersions(ctx, s, name)
+	if err != nil {
+		return err
+	}
+	for len(versions) > clientVersionHistory {
+		if err := s.Delete(ctx, fmt.Sprintf("client_version/%s/%d", name, versions[0])); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// clientVersion returns the given version of the named mapping, either from
+// the history or the current entry.
+func (b *backend) clientVersion(ctx context.Context, s logical.Storage, name string, version int) (*ClientEntry, error) {
+	current, err := b.Client(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.Version == version {
+		return current, nil
+	}
+
+	entry, err := s.Get(ctx, fmt.Sprintf("client_version/%s/%d", name, version))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ClientEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (b *backend) pathClientVersionsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	current, err := b.Client(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, nil
+	}
+
+	history, err := clientVersions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]interface{})
+	for _, v := range append(history, current.Version) {
+		client, err := b.clientVersion(ctx, req.Storage, name, v)
+		if err != nil {
+			return nil, err
+		}
+		if client == nil {
+			continue
+		}
+		versions[strconv.Itoa(v)] = map[string]interface{}{
+			"policies":          client.Policies,
+			"denied_policies":   client.DeniedPolicies,
+			"deny_login":        client.DenyLogin,
+			"description":       client.Description,
+			"owner":             client.Owner,
+			"expires_at":        client.expiresAt(),
+			"disabled":          client.Disabled,
+			"max_active_tokens": client.MaxActiveTokens,
+			"key_fingerprint":   client.KeyFingerprint,
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"current_version": current.Version,
+			"versions":        versions,
+		},
+	}, nil
+}
+
+func (b *backend) pathClientRollback(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	version := d.Get("version").(int)
+	if version <= 0 {
+		return logical.ErrorResponse("version must be greater than 0"), nil
+	}
+
+	var cas *int
+	if raw, ok := d.GetOk("cas"); ok {
+		v := raw.(int)
+		cas = &v
+	}
+
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	old, err := b.clientVersion(ctx, req.Storage, name, version)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return logical.ErrorResponse(fmt.Sprintf("version %d of client %q doesn't exist", version, name)), nil
+	}
+
+	// The policy ceiling may have changed since this version was written
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateMapping(old.Policies, old.DeniedPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	current, err := b.Client(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rolling back restores policies and settings, not a previous key pin
+	client := *old
+	client.KeyFingerprint = ""
+	if current != nil {
+		client.KeyFingerprint = current.KeyFingerprint
+	}
+	newVersion, err := b.putClientVersion(ctx, req.Storage, name, &client, cas)
+	if err != nil {
+		if _, ok := err.(*casError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": newVersion,
+		},
+	}, nil
+}
+
+const pathClientVersionsHelpSyn = `
+List the stored versions of a Chef client mapping
+`
+const pathClientVersionsHelpDesc = `
+Returns the current version of the mapping and the policies of every version that is
+still kept. The last 10 previous versions of every client mapping are kept.
+`
+
+const pathClientRollbackHelpSyn = `
+Restore a previous version of a Chef client mapping
+`
+const pathClientRollbackHelpDesc = `
+Writes the policies of the given version as a new version of the mapping. The restored
+policies are checked against the configured policy ceiling. The current key fingerprint
+of the mapping is kept.
+`
@@ -3,11 +3,14 @@ package chefnode
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
 	"net/url"
 
 	"github.com/fatih/structs"
 	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -20,6 +23,18 @@ func pathConfig(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: `The URL to the chef server api endpoint`,
 			},
+			"failover_urls": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of URLs of other endpoints of the same Chef
+server, tried in order when base_url fails with a connection error, a timeout or a
+5xx response.`,
+			},
+			"endpoint_cooldown": &framework.FieldSchema{
+				Type:    framework.TypeDurationSecond,
+				Default: int(defaultEndpointCooldown.Seconds()),
+				Description: `How long an endpoint that failed is skipped before it is tried
+again.`,
+			},
 			"client_name": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `Name of the client to connect to chef server with. This needs
@@ -33,12 +48,98 @@ server. This is generated when the client is created in the chef server`,
 			"default_policies": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `Comma seperated list of policies given to all tokens that
-successfully authenticate against this backend.`,
+successfully authenticate against this backend. Policy names may contain templates
+such as {{chef_environment}} that are rendered against the node object at login.
+Nodes can set most of their own attributes, so a template lets a node choose part of
+its policy name.`,
+			},
+			"allowed_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of policy name patterns, globs allowed. If set,
+only matching policies can be assigned by mappings or issued to tokens.`,
+			},
+			"disallowed_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of policy name patterns, globs allowed. Matching
+policies can never be assigned by mappings or issued to tokens.`,
+			},
+			"require_approval": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the first login of a Chef client without a client mapping
+is refused and the client is queued under pending/ until it is approved.`,
+			},
+			"tidy_interval": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `How often client mappings are checked against the clients on the
+Chef server. If 0, the check only runs when the tidy endpoint is called.`,
+			},
+			"tidy_grace_period": &framework.FieldSchema{
+				Type:    framework.TypeDurationSecond,
+				Default: int(defaultTidyGracePeriod.Seconds()),
+				Description: `How long a Chef client must be missing before tidy removes its
+client mapping.`,
+			},
+			"tidy_remove": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the periodic tidy removes stale client mappings. Otherwise
+it only reports them in tidy/status.`,
 			},
+			"renewal_policy_change": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "deny",
+				Description: `What to do when a token is renewed and the node's policies have changed
+since login. "deny" refuses the renewal, "allow_subset" renews it if policies were only
+added, and "allow" always renews it. Renewed tokens keep their original policies.`,
+			},
+			"max_active_tokens": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `Maximum number of active tokens a Chef client can have. Logins above
+the limit are refused. If 0, there is no limit. Client mappings can set their own limit.`,
+			},
+			"alias_source": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "client_name",
+				Description: `Source of the name of the identity alias of issued tokens. One of
+"client_name", "node_name", "fqdn" or "node_id". The fqdn and node_id attributes are
+reported by the node, so with those sources a node can claim another node's alias.`,
+			},
+			"metadata_attributes": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of node attribute paths, such as
+chef_environment or automatic.fqdn, copied into the metadata of issued tokens.
+Attributes that are missing or aren't strings, numbers or booleans are left out.`,
+			},
+			"display_name_template": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Template of the display name of issued tokens, rendered against the
+node object, such as {{chef_environment}}-{{automatic.hostname}}. If empty, or if the
+template can't be rendered, the client name is used.`,
+			},
+			"group_aliases": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, tokens carry identity group aliases for the node's Chef
+environment, roles and policy group.`,
+			},
+			"group_alias_environment_prefix": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Default:     "env:",
+				Description: "Prefix of the names of group aliases for Chef environments",
+			},
+			"group_alias_role_prefix": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Default:     "role:",
+				Description: "Prefix of the names of group aliases for Chef roles",
+			},
+			"group_alias_policy_group_prefix": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Default:     "policy_group:",
+				Description: "Prefix of the names of group aliases for Chef policy groups",
+			},
+			"preview": previewSchema,
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathConfigRead,
-			logical.UpdateOperation: b.pathConfigWrite,
+			logical.UpdateOperation: b.previewable(b.pathConfigWrite),
 		},
 		HelpSynopsis:    pathConfigHelpSyn,
 		HelpDescription: pathConfigHelpDesc,
@@ -57,33 +158,144 @@ func (b *backend) pathConfigRead(ctx context.Context, req *logical.Request, data
 	resp := &logical.Response{
 		Data: structs.New(cfg).Map(),
 	}
+	resp.Data["tidy_interval"] = int64(cfg.TidyInterval.Seconds())
+	resp.Data["tidy_grace_period"] = int64(cfg.TidyGracePeriod.Seconds())
+	resp.Data["endpoint_cooldown"] = int64(cfg.EndpointCooldown.Seconds())
 	resp.AddWarning("Read access to this endpoint should be controlled via ACLs as it will return the configuration information as-is, including any passwords.")
 	return resp, nil
 }
 
 func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	baseURL := data.Get("base_url").(string)
-	clientName := data.Get("client_name").(string)
-	clientKey := data.Get("client_key").(string)
-	defaultPolicies := policyutil.ParsePolicies(data.Get("default_policies").(string))
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
 
-	_, err := parsePrivateKey(clientKey)
+	cfg, err := b.Config(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = url.ParseRequestURI(baseURL)
+	// Fields that aren't given keep their stored value. Fields the stored
+	// config doesn't have yet, because it is new or predates them, take their
+	// default.
+	stored := map[string]interface{}{}
+	entry, err := req.Storage.Get(ctx, "config")
 	if err != nil {
 		return nil, err
 	}
+	if entry != nil {
+		if err := entry.DecodeJSON(&stored); err != nil {
+			return nil, fmt.Errorf("error reading configuration: %s", err)
+		}
+	}
+	given := func(k string) (interface{}, bool) {
+		if v, ok := data.GetOk(k); ok {
+			return v, true
+		}
+		if _, ok := stored[k]; ok {
+			return nil, false
+		}
+		return data.Get(k), true
+	}
+	setString := func(k string, cur *string) {
+		if v, ok := given(k); ok {
+			*cur = v.(string)
+		}
+	}
+	setList := func(k string, cur *[]string, parse func(string) []string) {
+		if v, ok := given(k); ok {
+			*cur = parse(v.(string))
+		}
+	}
+	setBool := func(k string, cur *bool) {
+		if v, ok := given(k); ok {
+			*cur = v.(bool)
+		}
+	}
+	setInt := func(k string, cur *int) {
+		if v, ok := given(k); ok {
+			*cur = v.(int)
+		}
+	}
+	setDuration := func(k string, cur *time.Duration) {
+		if v, ok := given(k); ok {
+			*cur = time.Duration(v.(int)) * time.Second
+		}
+	}
+	lowercaseList := func(s string) []string {
+		return strutil.ParseDedupLowercaseAndSortStrings(s, ",")
+	}
+	stringList := func(s string) []string {
+		return strutil.ParseStringSlice(s, ",")
+	}
+	sortedList := func(s string) []string {
+		return strutil.ParseDedupAndSortStrings(s, ",")
+	}
+
+	setString("base_url", &cfg.BaseURL)
+	setList("failover_urls", &cfg.FailoverURLs, stringList)
+	setDuration("endpoint_cooldown", &cfg.EndpointCooldown)
+	setString("client_name", &cfg.ClientName)
+	setString("client_key", &cfg.ClientKey)
+	setList("default_policies", &cfg.DefaultPolicies, func(s string) []string { return policyutil.ParsePolicies(s) })
+	setList("allowed_policies", &cfg.AllowedPolicies, lowercaseList)
+	setList("disallowed_policies", &cfg.DisallowedPolicies, lowercaseList)
+	setBool("require_approval", &cfg.RequireApproval)
+	setDuration("tidy_interval", &cfg.TidyInterval)
+	setDuration("tidy_grace_period", &cfg.TidyGracePeriod)
+	setBool("tidy_remove", &cfg.TidyRemove)
+	setString("renewal_policy_change", &cfg.RenewalPolicyChange)
+	setInt("max_active_tokens", &cfg.MaxActiveTokens)
+	setString("alias_source", &cfg.AliasSource)
+	setList("metadata_attributes", &cfg.MetadataAttributes, sortedList)
+	setString("display_name_template", &cfg.DisplayNameTemplate)
+	setBool("group_aliases", &cfg.GroupAliases)
+	setString("group_alias_environment_prefix", &cfg.GroupAliasEnvironmentPrefix)
+	setString("group_alias_role_prefix", &cfg.GroupAliasRolePrefix)
+	setString("group_alias_policy_group_prefix", &cfg.GroupAliasPolicyGroupPrefix)
+
+	_, err = parsePrivateKey(cfg.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validatePolicyTemplates(cfg.DefaultPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	switch cfg.RenewalPolicyChange {
+	case "deny", "allow_subset", "allow":
+	default:
+		return logical.ErrorResponse(`renewal_policy_change must be "deny", "allow_subset" or "allow"`), nil
+	}
+
+	for _, path := range cfg.MetadataAttributes {
+		if strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return logical.ErrorResponse(fmt.Sprintf("malformed attribute path %q in metadata_attributes", path)), nil
+		}
+	}
+
+	if err := validateTemplate(cfg.DisplayNameTemplate); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if _, ok := aliasSources[cfg.AliasSource]; !ok {
+		return logical.ErrorResponse(`alias_source must be "client_name", "node_name", "fqdn" or "node_id"`), nil
+	}
+
+	for _, u := range cfg.endpoints() {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, err
+		}
+	}
 
-	entry, err := logical.StorageEntryJSON("config", config{
-		BaseURL:         baseURL,
-		ClientName:      clientName,
-		ClientKey:       clientKey,
-		DefaultPolicies: defaultPolicies,
-	})
+	if cfg.MaxActiveTokens < 0 {
+		return logical.ErrorResponse("max_active_tokens can't be negative"), nil
+	}
+	if err := cfg.checkPolicies(cfg.DefaultPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
 
+	entry, err = logical.StorageEntryJSON("config", cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +303,9 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, dat
 	if err := req.Storage.Put(ctx, entry); err != nil {
 		return nil, err
 	}
+	if !isPreview(req) {
+		b.resetRoleCache()
+	}
 
 	return nil, nil
 }
@@ -111,11 +326,72 @@ func (b *backend) Config(ctx context.Context, s logical.Storage) (*config, error
 	return &result, nil
 }
 
+// permitsPolicy reports whether the mount-wide allowed and disallowed policy
+// patterns permit the policy. The default policy is always allowed unless it is
+// explicitly disallowed.
+func (c *config) permitsPolicy(policy string) bool {
+	if strutil.StrListContainsGlob(c.DisallowedPolicies, policy) {
+		return false
+	}
+	if len(c.AllowedPolicies) == 0 || policy == "default" {
+		return true
+	}
+	return strutil.StrListContainsGlob(c.AllowedPolicies, policy)
+}
+
+// checkPolicies returns an error naming any policy that isn't permitted.
+// Templated policies are skipped since they can only be checked once rendered.
+func (c *config) checkPolicies(policies []string) error {
+	var bad []string
+	for _, p := range policies {
+		if !isTemplate(p) && !c.permitsPolicy(p) {
+			bad = append(bad, p)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("policies not permitted by allowed_policies/disallowed_policies: %s", strings.Join(bad, ","))
+	}
+	return nil
+}
+
+// validateMapping checks the policies and denied policies of a mapping before
+// it is saved.
+func (c *config) validateMapping(policies []string, denied []string) error {
+	if err := validatePolicyTemplates(policies); err != nil {
+		return err
+	}
+	if err := validatePolicyTemplates(denied); err != nil {
+		return err
+	}
+	return c.checkPolicies(policies)
+}
+
 type config struct {
-	BaseURL         string   `json:"base_url" structs:"base_url"`
-	ClientKey       string   `json:"client_key" structs:"client_key"`
-	ClientName      string   `json:"client_name" structs:"client_name"`
-	DefaultPolicies []string `json:"default_policies" structs:"default_policies"`
+	BaseURL            string   `json:"base_url" structs:"base_url"`
+	FailoverURLs       []string `json:"failover_urls" structs:"failover_urls"`
+	ClientKey          string   `json:"client_key" structs:"client_key"`
+	ClientName         string   `json:"client_name" structs:"client_name"`
+	DefaultPolicies    []string `json:"default_policies" structs:"default_policies"`
+	AllowedPolicies    []string `json:"allowed_policies" structs:"allowed_policies"`
+	DisallowedPolicies []string `json:"disallowed_policies" structs:"disallowed_policies"`
+	RequireApproval    bool     `json:"require_approval" structs:"require_approval"`
+
+	TidyInterval    time.Duration `json:"tidy_interval" structs:"-"`
+	TidyGracePeriod time.Duration `json:"tidy_grace_period" structs:"-"`
+	TidyRemove      bool          `json:"tidy_remove" structs:"tidy_remove"`
+
+	EndpointCooldown time.Duration `json:"endpoint_cooldown" structs:"-"`
+
+	RenewalPolicyChange string   `json:"renewal_policy_change" structs:"renewal_policy_change"`
+	MaxActiveTokens     int      `json:"max_active_tokens" structs:"max_active_tokens"`
+	AliasSource         string   `json:"alias_source" structs:"alias_source"`
+	MetadataAttributes  []string `json:"metadata_attributes" structs:"metadata_attributes"`
+	DisplayNameTemplate string   `json:"display_name_template" structs:"display_name_template"`
+
+	GroupAliases                bool   `json:"group_aliases" structs:"group_aliases"`
+	GroupAliasEnvironmentPrefix string `json:"group_alias_environment_prefix" structs:"group_alias_environment_prefix"`
+	GroupAliasRolePrefix        string `json:"group_alias_role_prefix" structs:"group_alias_role_prefix"`
+	GroupAliasPolicyGroupPrefix string `json:"group_alias_policy_group_prefix" structs:"group_alias_policy_group_prefix"`
 }
 
 const pathConfigHelpSyn = `
@@ -125,5 +401,6 @@ const pathConfigHelpDesc = `
 Configure the URL of the chef server API endpoint and the client name and key used to
 make API requests to it.  The client must be already created in the chef server.
 Optionally add a default set of policies all clients authenticating against this endpoint
-will receive.
+will receive, and limit the policies that mappings can assign with allowed_policies and
+disallowed_policies.
 `
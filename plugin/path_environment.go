@@ -0,0 +1,154 @@
+package chefnode
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathEnvironmentsList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "environments/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathEnvironmentList,
+		},
+		HelpSynopsis:    pathEnvironmentHelpSyn,
+		HelpDescription: pathEnvironmentHelpDesc,
+	}
+}
+
+func pathEnvironments(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `environment/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef environment, qualified as <server>:<organization>/<environment> for a named Chef server or an organization",
+			},
+			"policies": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Comma-seperated list of policies associated to nodes in this Chef environment",
+			},
+			"denied_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of policies removed from the final policy set
+of nodes in this Chef environment, regardless of which mapping granted them.`,
+			},
+			"deny_login": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, nodes in this Chef environment are not allowed to log in.",
+			},
+			"preview": previewSchema,
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathEnvironmentDelete,
+			logical.ReadOperation:   b.pathEnvironmentRead,
+			logical.UpdateOperation: b.previewable(b.pathEnvironmentWrite),
+		},
+		HelpSynopsis:    pathEnvironmentHelpSyn,
+		HelpDescription: pathEnvironmentHelpDesc,
+	}
+}
+
+func (b *backend) pathEnvironmentList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	envs, err := listClients(ctx, req.Storage, "environment/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(envs), nil
+}
+
+func (b *backend) Environment(ctx context.Context, s logical.Storage, n string) (*EnvironmentEntry, error) {
+	entry, err := s.Get(ctx, "environment/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result EnvironmentEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathEnvironmentDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+
+	err := req.Storage.Delete(ctx, "environment/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathEnvironmentRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	env, err := b.Environment(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"policies":        env.Policies,
+			"denied_policies": env.DeniedPolicies,
+			"deny_login":      env.DenyLogin,
+		},
+	}, nil
+}
+
+func (b *backend) pathEnvironmentWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	env := &EnvironmentEntry{
+		Policies:       policyutil.ParsePolicies(d.Get("policies").(string)),
+		DeniedPolicies: policyutil.ParsePolicies(d.Get("denied_policies").(string)),
+		DenyLogin:      d.Get("deny_login").(bool),
+	}
+
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateMapping(env.Policies, env.DeniedPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+
+	entry, err := logical.StorageEntryJSON("environment/"+d.Get("name").(string), env)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type EnvironmentEntry struct {
+	Policies       []string
+	DeniedPolicies []string
+	DenyLogin      bool
+}
+
+const pathEnvironmentHelpSyn = `
+Manage Vault policies assigned to nodes in a Chef environment
+`
+const pathEnvironmentHelpDesc = `
+This endpoint allows you to create, read, update, and delete configuration for policies
+associated with Chef environments. An environment can also deny policies granted by
+other mappings, or block login for all of its nodes. The mappings of an environment of
+a named Chef server or of an organization are written to
+environment/<server>:<organization>/<environment> and only apply to its nodes.
+`
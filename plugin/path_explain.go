@@ -0,0 +1,152 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathExplain(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `explain/(?P<client_name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"client_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client to evaluate",
+			},
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Optional name of the role to evaluate the login with",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathExplain,
+			logical.UpdateOperation: b.pathExplain,
+		},
+		HelpSynopsis:    pathExplainHelpSyn,
+		HelpDescription: pathExplainHelpDesc,
+	}
+}
+
+func (b *backend) pathExplain(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client := d.Get("client_name").(string)
+	roleName := d.Get("role").(string)
+
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	loader := b.nodeLoader(ctx, req, client)
+	mappings, err := b.nodeMappings(ctx, req, client, loader)
+	if err != nil {
+		return nil, err
+	}
+
+	var gates []string
+	if err := b.checkQuarantine(ctx, req.Storage, client); err != nil {
+		if _, ok := err.(*quarantinedError); !ok {
+			return nil, err
+		}
+		gates = append(gates, err.Error())
+	}
+	if err := b.checkFreeze(ctx, req, loader); err != nil {
+		if _, ok := err.(*frozenError); !ok {
+			return nil, err
+		}
+		gates = append(gates, err.Error())
+	}
+	pending, err := b.requiresApproval(ctx, req, client)
+	if err != nil {
+		return nil, err
+	}
+	if pending {
+		gates = append(gates, fmt.Sprintf("client %q requires approval", client))
+	}
+	limit, err := b.maxActiveTokens(ctx, req.Storage, client)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 {
+		b.tokenLock.Lock()
+		tokens, err := b.activeTokens(ctx, req.Storage, client)
+		b.tokenLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if len(tokens) >= limit {
+			gates = append(gates, (&tokenLimitError{client: client, limit: limit}).Error())
+		}
+	}
+
+	var base *policyMapping
+	if roleName != "" {
+		role, err := b.Role(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("role %q not found", roleName)), nil
+		}
+		node, err := loader.get()
+		if err != nil {
+			return nil, err
+		}
+		chefRoles, err := loader.roles()
+		if err != nil {
+			return nil, err
+		}
+		if err := role.validateNode(client, node, chefRoles); err != nil {
+			gates = append(gates, err.Error())
+		}
+		base = &policyMapping{
+			Kind:     "role",
+			Name:     roleName,
+			Policies: role.TokenPolicies,
+		}
+	}
+
+	eval, err := evaluatePolicies(config, base, mappings, base == nil, loader)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range eval.LoginDenied {
+		gates = append(gates, (&loginDeniedError{mapping: m}).Error())
+	}
+	for _, u := range eval.Unrendered {
+		gates = append(gates, u.Error())
+	}
+
+	var applied []string
+	if base != nil {
+		applied = append(applied, base.source())
+	}
+	for _, m := range mappings {
+		applied = append(applied, m.source())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"policies":          eval.Policies,
+			"sources":           eval.Sources,
+			"denied_policies":   eval.Denied,
+			"filtered_policies": eval.Filtered,
+			"mappings":          applied,
+			"failed_gates":      gates,
+			"login_allowed":     len(gates) == 0,
+		},
+	}, nil
+}
+
+const pathExplainHelpSyn = `
+Explain how the policies for a Chef client are computed.
+`
+
+const pathExplainHelpDesc = `
+Runs the same policy evaluation as a login for the given Chef client without
+authenticating it or issuing a token. The response lists the final policies, the
+mappings that granted each of them, policies removed by denials or by the mount's
+allowed and disallowed policies, and any check that would cause a login to fail.
+An optional role evaluates the login as if it was made with that role.
+`
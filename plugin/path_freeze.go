@@ -0,0 +1,268 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+var freezeFields = map[string]*framework.FieldSchema{
+	"message": &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Message returned to nodes whose login is refused",
+	},
+	"ends_at": &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `RFC 3339 timestamp after which logins are allowed again. If empty,
+the freeze lasts until it is deleted.`,
+	},
+}
+
+func pathFreezeGlobal(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "freeze",
+		Fields:  freezeFields,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathFreezeDelete,
+			logical.ReadOperation:   b.pathFreezeRead,
+			logical.UpdateOperation: b.pathFreezeWrite,
+		},
+		HelpSynopsis:    pathFreezeHelpSyn,
+		HelpDescription: pathFreezeHelpDesc,
+	}
+}
+
+func pathFreezes(b *backend) *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"environment": &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Name of the Chef environment",
+		},
+	}
+	for k, v := range freezeFields {
+		fields[k] = v
+	}
+
+	return &framework.Path{
+		Pattern: `freeze/(?P<environment>.+)`,
+		Fields:  fields,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathFreezeDelete,
+			logical.ReadOperation:   b.pathFreezeRead,
+			logical.UpdateOperation: b.pathFreezeWrite,
+		},
+		HelpSynopsis:    pathFreezeHelpSyn,
+		HelpDescription: pathFreezeHelpDesc,
+	}
+}
+
+func pathFreezesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "freezes/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathFreezeList,
+		},
+		HelpSynopsis:    pathFreezeHelpSyn,
+		HelpDescription: pathFreezeHelpDesc,
+	}
+}
+
+// freezeKey returns the storage key of the freeze for the environment, or of
+// the global freeze if environment is empty.
+func freezeKey(environment string) string {
+	if environment == "" {
+		return "freeze_global"
+	}
+	return "freeze/" + environment
+}
+
+// frozenError is returned when a login is refused by a freeze.
+type frozenError struct {
+	environment string
+	message     string
+}
+
+func (e *frozenError) Error() string {
+	if e.message != "" {
+		return e.message
+	}
+	if e.environment == "" {
+		return "logins are frozen"
+	}
+	return fmt.Sprintf("logins are frozen for environment %q", e.environment)
+}
+
+// checkFreeze returns a frozenError if logins are frozen globally or for the
+// node's environment on its Chef server and organization. The node is only
+// fetched if an environment is frozen, and a client without a node object is
+// only affected by the global freeze.
+func (b *backend) checkFreeze(ctx context.Context, req *logical.Request, node *nodeLoader) error {
+	now := time.Now()
+	global, err := b.Freeze(ctx, req.Storage, "")
+	if err != nil {
+		return err
+	}
+	if global != nil && global.active(now) {
+		return &frozenError{message: global.Message}
+	}
+
+	envs, err := req.Storage.List(ctx, "freeze/")
+	if err != nil {
+		return err
+	}
+	if len(envs) == 0 {
+		return nil
+	}
+	n, err := node.get()
+	if isNotFound(err) {
+		// A client without a node object isn't in any environment
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	env := qualifyClient(n.server, n.org, n.Environment)
+	freeze, err := b.Freeze(ctx, req.Storage, env)
+	if err != nil {
+		return err
+	}
+	if freeze != nil && freeze.active(now) {
+		return &frozenError{environment: env, message: freeze.Message}
+	}
+	return nil
+}
+
+// Freeze returns the freeze of the environment, or the global freeze if
+// environment is empty.
+func (b *backend) Freeze(ctx context.Context, s logical.Storage, environment string) (*FreezeEntry, error) {
+	entry, err := s.Get(ctx, freezeKey(environment))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result FreezeEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// freezeEnvironment returns the environment of the request, which is empty for
+// the global freeze.
+func freezeEnvironment(d *framework.FieldData) string {
+	if _, ok := d.Schema["environment"]; !ok {
+		return ""
+	}
+	return d.Get("environment").(string)
+}
+
+func (b *backend) pathFreezeList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := listClients(ctx, req.Storage, "freeze/")
+	if err != nil {
+		return nil, err
+	}
+
+	// Only freezes that are still in effect are listed
+	now := time.Now()
+	var envs []string
+	keyInfo := make(map[string]interface{})
+	for _, name := range names {
+		freeze, err := b.Freeze(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if freeze == nil || !freeze.active(now) {
+			continue
+		}
+		envs = append(envs, name)
+		keyInfo[name] = freeze.data()
+	}
+	return logical.ListResponseWithInfo(envs, keyInfo), nil
+}
+
+func (b *backend) pathFreezeRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	freeze, err := b.Freeze(ctx, req.Storage, freezeEnvironment(d))
+	if err != nil {
+		return nil, err
+	}
+	if freeze == nil {
+		return nil, nil
+	}
+
+	data := freeze.data()
+	data["active"] = freeze.active(time.Now())
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+func (b *backend) pathFreezeWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	freeze := &FreezeEntry{
+		Message: d.Get("message").(string),
+	}
+	if raw := d.Get("ends_at").(string); raw != "" {
+		endsAt, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("couldn't parse ends_at: %s", err)), nil
+		}
+		freeze.EndsAt = endsAt.UTC()
+	}
+
+	entry, err := logical.StorageEntryJSON(freezeKey(freezeEnvironment(d)), freeze)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathFreezeDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, freezeKey(freezeEnvironment(d)))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type FreezeEntry struct {
+	Message string    `json:"message"`
+	EndsAt  time.Time `json:"ends_at"`
+}
+
+// active returns whether the freeze is still in effect at the given time.
+func (f *FreezeEntry) active(now time.Time) bool {
+	return f.EndsAt.IsZero() || now.Before(f.EndsAt)
+}
+
+func (f *FreezeEntry) data() map[string]interface{} {
+	endsAt := ""
+	if !f.EndsAt.IsZero() {
+		endsAt = f.EndsAt.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"message": f.Message,
+		"ends_at": endsAt,
+	}
+}
+
+const pathFreezeHelpSyn = `
+Pause logins globally or for a Chef environment
+`
+const pathFreezeHelpDesc = `
+While a freeze is in effect, logins are refused with the freeze's message. The freeze
+endpoint applies to every node, and freeze/<environment> only to nodes in that Chef
+environment. Environments of a named Chef server or of an organization are qualified
+the same way as client names, as in freeze/<server>:<organization>/<environment>.
+Tokens that were already issued can still be renewed.
+`
@@ -0,0 +1,469 @@
+package chefnode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathExport(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "export",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathExport,
+		},
+		HelpSynopsis:    pathExportHelpSyn,
+		HelpDescription: pathExportHelpDesc,
+	}
+}
+
+func pathImport(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "import",
+		Fields: map[string]*framework.FieldSchema{
+			"mappings": &framework.FieldSchema{
+				Type:        framework.TypeMap,
+				Description: "Mapping document in the format returned by the export endpoint",
+			},
+			"mode": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "merge",
+				Description: `Either "merge" to only add or overwrite the mappings in the document,
+or "replace" to also delete every mapping that isn't in the document.`,
+			},
+			"preview": previewSchema,
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.previewable(b.pathImport),
+		},
+		HelpSynopsis:    pathImportHelpSyn,
+		HelpDescription: pathImportHelpDesc,
+	}
+}
+
+// mappingDocument is the format used to import and export every policy
+// mapping of the backend at once.
+type mappingDocument struct {
+	DefaultPolicies *[]string                         `json:"default_policies,omitempty"`
+	Clients         map[string]*clientDocEntry        `json:"clients"`
+	ClientPatterns  map[string]*clientPatternDocEntry `json:"client_patterns"`
+	Environments    map[string]*mappingDocEntry       `json:"environments"`
+	ChefRoles       map[string]*mappingDocEntry       `json:"chef_roles"`
+}
+
+type mappingDocEntry struct {
+	Policies       []string `json:"policies"`
+	DeniedPolicies []string `json:"denied_policies,omitempty"`
+	DenyLogin      bool     `json:"deny_login,omitempty"`
+}
+
+type clientDocEntry struct {
+	mappingDocEntry
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+
+	MaxActiveTokens int    `json:"max_active_tokens,omitempty"`
+	KeyFingerprint  string `json:"key_fingerprint,omitempty"`
+}
+
+type clientPatternDocEntry struct {
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	Priority    int    `json:"priority"`
+	mappingDocEntry
+}
+
+func newMappingDocEntry(policies []string, denied []string, denyLogin bool) *mappingDocEntry {
+	return &mappingDocEntry{
+		Policies:       policies,
+		DeniedPolicies: denied,
+		DenyLogin:      denyLogin,
+	}
+}
+
+func (b *backend) pathExport(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	doc := &mappingDocument{
+		DefaultPolicies: &config.DefaultPolicies,
+		Clients:         make(map[string]*clientDocEntry),
+		ClientPatterns:  make(map[string]*clientPatternDocEntry),
+		Environments:    make(map[string]*mappingDocEntry),
+		ChefRoles:       make(map[string]*mappingDocEntry),
+	}
+
+	names, err := listClients(ctx, req.Storage, "client/")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		e, err := b.Client(ctx, req.Storage, n)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			doc.Clients[n] = &clientDocEntry{
+				mappingDocEntry: *newMappingDocEntry(e.Policies, e.DeniedPolicies, e.DenyLogin),
+				Description:     e.Description,
+				Owner:           e.Owner,
+				ExpiresAt:       e.expiresAt(),
+				Disabled:        e.Disabled,
+				MaxActiveTokens: e.MaxActiveTokens,
+				KeyFingerprint:  e.KeyFingerprint,
+			}
+		}
+	}
+
+	names, err = listClients(ctx, req.Storage, "client_pattern/")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		e, err := b.ClientPattern(ctx, req.Storage, n)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			doc.ClientPatterns[n] = &clientPatternDocEntry{
+				Pattern:         e.Pattern,
+				PatternType:     e.PatternType,
+				Priority:        e.Priority,
+				mappingDocEntry: *newMappingDocEntry(e.Policies, e.DeniedPolicies, e.DenyLogin),
+			}
+		}
+	}
+
+	names, err = listClients(ctx, req.Storage, "environment/")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		e, err := b.Environment(ctx, req.Storage, n)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			doc.Environments[n] = newMappingDocEntry(e.Policies, e.DeniedPolicies, e.DenyLogin)
+		}
+	}
+
+	names, err = listClients(ctx, req.Storage, "chef_role/")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		e, err := b.ChefRole(ctx, req.Storage, n)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			doc.ChefRoles[n] = newMappingDocEntry(e.Policies, e.DeniedPolicies, e.DenyLogin)
+		}
+	}
+
+	// Round trip through JSON so the response has the same shape as the
+	// document accepted by import
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"mappings": data,
+		},
+	}, nil
+}
+
+func (b *backend) pathImport(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	mode := d.Get("mode").(string)
+	if mode != "merge" && mode != "replace" {
+		return logical.ErrorResponse(`mode must be "merge" or "replace"`), nil
+	}
+
+	raw, err := json.Marshal(d.Get("mappings"))
+	if err != nil {
+		return nil, err
+	}
+	var doc mappingDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("couldn't parse mappings: %s", err)), nil
+	}
+
+	// The mappings and the config can't change between building the changes
+	// and applying them
+	b.mappingLock.Lock()
+	defer b.mappingLock.Unlock()
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build and validate every entry before anything is written
+	puts := make(map[string]interface{})
+	addMapping := func(prefix string, name string, e *mappingDocEntry, entry func(*mappingDocEntry) interface{}) error {
+		if e == nil {
+			return fmt.Errorf("%s%s: mapping is empty", prefix, name)
+		}
+		e.Policies = policyutil.ParsePolicies(e.Policies)
+		e.DeniedPolicies = policyutil.ParsePolicies(e.DeniedPolicies)
+		if err := config.validateMapping(e.Policies, e.DeniedPolicies); err != nil {
+			return fmt.Errorf("%s%s: %s", prefix, name, err)
+		}
+		puts[prefix+name] = entry(e)
+		return nil
+	}
+
+	for name, e := range doc.Clients {
+		if e == nil {
+			return logical.ErrorResponse(fmt.Sprintf("client/%s: mapping is empty", name)), nil
+		}
+		client := &ClientEntry{
+			Description:     e.Description,
+			Owner:           e.Owner,
+			Disabled:        e.Disabled,
+			MaxActiveTokens: e.MaxActiveTokens,
+			KeyFingerprint:  e.KeyFingerprint,
+			Version:         1,
+		}
+		if e.MaxActiveTokens < 0 {
+			return logical.ErrorResponse(fmt.Sprintf("client/%s: max_active_tokens can't be negative", name)), nil
+		}
+		if e.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, e.ExpiresAt)
+			if err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("client/%s: couldn't parse expires_at: %s", name, err)), nil
+			}
+			client.ExpiresAt = expiresAt.UTC()
+		}
+		err := addMapping("client/", name, &e.mappingDocEntry, func(e *mappingDocEntry) interface{} {
+			client.Policies = e.Policies
+			client.DeniedPolicies = e.DeniedPolicies
+			client.DenyLogin = e.DenyLogin
+			return client
+		})
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	for name, e := range doc.Environments {
+		err := addMapping("environment/", name, e, func(e *mappingDocEntry) interface{} {
+			return &EnvironmentEntry{
+				Policies:       e.Policies,
+				DeniedPolicies: e.DeniedPolicies,
+				DenyLogin:      e.DenyLogin,
+			}
+		})
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	for name, e := range doc.ChefRoles {
+		err := addMapping("chef_role/", name, e, func(e *mappingDocEntry) interface{} {
+			return &ChefRoleEntry{
+				Policies:       e.Policies,
+				DeniedPolicies: e.DeniedPolicies,
+				DenyLogin:      e.DenyLogin,
+			}
+		})
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+	for name, e := range doc.ClientPatterns {
+		if e == nil {
+			return logical.ErrorResponse(fmt.Sprintf("client_pattern/%s: mapping is empty", name)), nil
+		}
+		if e.PatternType == "" {
+			e.PatternType = "glob"
+		}
+		pattern := &ClientPatternEntry{
+			Pattern:     e.Pattern,
+			PatternType: e.PatternType,
+			Priority:    e.Priority,
+		}
+		if err := pattern.validate(); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("client_pattern/%s: %s", name, err)), nil
+		}
+		err := addMapping("client_pattern/", name, &e.mappingDocEntry, func(e *mappingDocEntry) interface{} {
+			pattern.Policies = e.Policies
+			pattern.DeniedPolicies = e.DeniedPolicies
+			pattern.DenyLogin = e.DenyLogin
+			return pattern
+		})
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	setDefaults := doc.DefaultPolicies != nil || mode == "replace"
+	if setDefaults {
+		var defaults []string
+		if doc.DefaultPolicies != nil {
+			defaults = policyutil.ParsePolicies(*doc.DefaultPolicies)
+		}
+		if err := config.validateMapping(defaults, nil); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("default_policies: %s", err)), nil
+		}
+		if config.BaseURL != "" {
+			config.DefaultPolicies = defaults
+			puts["config"] = config
+		} else if len(defaults) > 0 {
+			return logical.ErrorResponse("the backend must be configured before importing default_policies"), nil
+		}
+	}
+
+	var deletes []string
+	if mode == "replace" {
+		for _, prefix := range []string{"client/", "client_pattern/", "environment/", "chef_role/"} {
+			names, err := listClients(ctx, req.Storage, prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range names {
+				if _, ok := puts[prefix+n]; !ok {
+					deletes = append(deletes, prefix+n)
+				}
+			}
+		}
+	}
+
+	written, deleted := len(puts), len(deletes)
+
+	// Imported client mappings are stored as a new version, and the history of
+	// deleted ones is removed, the same as through the client endpoint
+	for name := range doc.Clients {
+		existing, err := b.Client(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			continue
+		}
+		client := puts["client/"+name].(*ClientEntry)
+		client.Version = existing.Version + 1
+		// Keep the approved key of the client unless the document sets one
+		if client.KeyFingerprint == "" {
+			client.KeyFingerprint = existing.KeyFingerprint
+		}
+		puts[fmt.Sprintf("client_version/%s/%d", name, existing.Version)] = existing
+	}
+	for _, key := range deletes {
+		if !strings.HasPrefix(key, "client/") {
+			continue
+		}
+		name := strings.TrimPrefix(key, "client/")
+		versions, err := clientVersions(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			deletes = append(deletes, fmt.Sprintf("client_version/%s/%d", name, v))
+		}
+	}
+
+	if err := applyStorageChanges(ctx, req.Storage, puts, deletes); err != nil {
+		return nil, err
+	}
+	for name := range doc.Clients {
+		if err := pruneClientVersions(ctx, req.Storage, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"written": written,
+			"deleted": deleted,
+		},
+	}, nil
+}
+
+// applyStorageChanges writes and deletes the given entries. If any operation
+// fails, the previous values of every touched entry are restored.
+func applyStorageChanges(ctx context.Context, s logical.Storage, puts map[string]interface{}, deletes []string) error {
+	var keys []string
+	for k := range puts {
+		keys = append(keys, k)
+	}
+	keys = append(keys, deletes...)
+
+	previous := make(map[string]*logical.StorageEntry)
+	for _, k := range keys {
+		entry, err := s.Get(ctx, k)
+		if err != nil {
+			return err
+		}
+		previous[k] = entry
+	}
+
+	err := func() error {
+		for k, v := range puts {
+			entry, err := logical.StorageEntryJSON(k, v)
+			if err != nil {
+				return err
+			}
+			if err := s.Put(ctx, entry); err != nil {
+				return err
+			}
+		}
+		for _, k := range deletes {
+			if err := s.Delete(ctx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err == nil {
+		return nil
+	}
+
+	for k, entry := range previous {
+		if entry == nil {
+			s.Delete(ctx, k)
+		} else {
+			s.Put(ctx, entry)
+		}
+	}
+	return fmt.Errorf("couldn't apply mappings, previous mappings were restored: %s", err)
+}
+
+const pathExportHelpSyn = `
+Export every policy mapping as a single document.
+`
+
+const pathExportHelpDesc = `
+Returns the default policies and every client, client pattern, environment, and Chef
+role mapping in the format accepted by the import endpoint. Login roles aren't policy
+mappings and aren't included; they are managed through the role endpoint.
+`
+
+const pathImportHelpSyn = `
+Import a document containing policy mappings.
+`
+
+const pathImportHelpDesc = `
+Validates every mapping in the document before writing any of them. In "merge" mode
+the mappings in the document are added or overwritten and all others are kept. In
+"replace" mode every mapping that isn't in the document is deleted and the default
+policies are replaced. Other writes to the mappings and the config wait until the
+import is done, and if a write fails, the previous mappings are restored. Login roles
+aren't affected by imports.
+`
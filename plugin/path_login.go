@@ -6,8 +6,10 @@ import (
 	"crypto"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math"
@@ -16,17 +18,15 @@ import (
 	"strings"
 
 	"net/url"
+	"path"
 
 	"time"
 
 	"io/ioutil"
 
-	"encoding/json"
-
 	"io"
 
 	"github.com/hashicorp/vault/helper/policyutil"
-	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -59,6 +59,23 @@ that the timestamp is within 5 minutes of vaults current time.`,
 X-Ops-Authorization-* headers returned by mixlib-authentication. The value should be given
 as one value rather than the split value generated by mixlib-authentication.`,
 			},
+			"role": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Optional name of the role to log in with. When set, the token
+receives only the role's policies and the node must satisfy the role's bound constraints.`,
+			},
+			"organization": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Optional name of the Chef organization the client belongs to. If set,
+the client is looked up in that organization and its mappings are namespaced under
+<organization>/<client>.`,
+			},
+			"server": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Optional name of the Chef server the client belongs to. If empty, the
+server is chosen by the client_prefixes of the configured servers, falling back to the
+server in the config.`,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.UpdateOperation: b.pathLogin,
@@ -69,18 +86,36 @@ as one value rather than the split value generated by mixlib-authentication.`,
 }
 
 func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
-	client := data.Get("client_name").(string)
+	clientName := data.Get("client_name").(string)
 	ts := data.Get("timestamp").(string)
 	sig := data.Get("signature").(string)
 	sigVer := data.Get("signature_version").(string)
 
+	org := data.Get("organization").(string)
+	if strings.ContainsAny(clientName, ":/") {
+		return logical.ErrorResponse("invalid client name"), nil
+	}
+	if strings.ContainsAny(org, ":/") {
+		return logical.ErrorResponse("invalid organization"), nil
+	}
+	server, err := b.selectServer(ctx, req.Storage, data.Get("server").(string), clientName)
+	if _, ok := err.(*serverNotFoundError); ok {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Mappings and state of clients of a named server or an organization are
+	// kept under the qualified name
+	client := qualifyClient(server, org, clientName)
+
 	keys, err := b.retrievePubKey(ctx, req, client)
 	if err != nil {
 		return nil, err
 	}
 	reqPath := "/v1/" + req.MountPoint + req.Path
-	auth := authenticate(client, ts, sig, sigVer, keys, reqPath)
-	if !auth {
+	key := verifyingKey(clientName, ts, sig, sigVer, keys, reqPath)
+	if key == nil {
 		return logical.ErrorResponse("Couldn't authenticate client"), nil
 	}
 
@@ -95,60 +130,276 @@ func (b *backend) pathLogin(ctx context.Context, req *logical.Request, data *fra
 		return nil, fmt.Errorf("clock skew is too great for request")
 	}
 
-	policies, err := b.getNodePolicies(ctx, req, client)
+	// The quarantine is checked only after the signature, so that whether a
+	// client is quarantined is only revealed to the client itself
+	if err := b.checkQuarantine(ctx, req.Storage, client); err != nil {
+		if _, ok := err.(*quarantinedError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
+	fingerprint, err := keyFingerprint(key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := b.Client(ctx, req.Storage, client)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && entry.KeyFingerprint != "" && entry.KeyFingerprint != fingerprint {
+		return logical.ErrorResponse(fmt.Sprintf("key of client %q doesn't match the key fingerprint of its client mapping", client)), nil
+	}
+
+	loader := b.nodeLoader(ctx, req, client)
+	pending, err := b.requiresApproval(ctx, req, client)
 	if err != nil {
 		return nil, err
 	}
+	if pending {
+		if err := b.queuePendingClient(ctx, req, client, key); err != nil {
+			return nil, err
+		}
+		return logical.ErrorResponse(fmt.Sprintf("client %q is pending approval", client)), nil
+	}
 
-	return &logical.Response{
-		Auth: &logical.Auth{
-			Policies:    policies,
-			DisplayName: client,
-			LeaseOptions: logical.LeaseOptions{
-				Renewable: true,
-			},
-			InternalData: map[string]interface{}{
-				"request_path":      reqPath,
-				"signature_version": data.Get("signature_version"),
-				"signature":         data.Get("signature"),
-				"client_name":       data.Get("client_name"),
-				"timestamp":         data.Get("timestamp"),
-			},
+	if err := b.checkFreeze(ctx, req, loader); err != nil {
+		if _, ok := err.(*frozenError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
+	auth := &logical.Auth{
+		DisplayName: client,
+		LeaseOptions: logical.LeaseOptions{
+			Renewable: true,
 		},
+		InternalData: map[string]interface{}{
+			"client_name":     client,
+			"key_fingerprint": fingerprint,
+		},
+	}
+
+	roleName := data.Get("role").(string)
+	if roleName != "" {
+		role, err := b.roleForNode(ctx, req, roleName, client, loader)
+		switch err.(type) {
+		case nil:
+		case *roleError, *loginDeniedError, *unrenderedDenialError:
+			return logical.ErrorResponse(err.Error()), nil
+		default:
+			return nil, err
+		}
+		auth.Policies = role.TokenPolicies
+		auth.TTL = role.TTL
+		auth.MaxTTL = role.MaxTTL
+		auth.InternalData["role"] = roleName
+	} else {
+		policies, err := b.nodePolicies(ctx, req, client, loader)
+		switch err.(type) {
+		case nil:
+		case *loginDeniedError, *unrenderedDenialError:
+			return logical.ErrorResponse(err.Error()), nil
+		default:
+			return nil, err
+		}
+		auth.Policies = policies
+	}
+
+	if err := b.setAuthIdentity(ctx, req, auth, client, loader, fingerprint); err != nil {
+		if _, ok := err.(*aliasError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
+	if err := b.checkTokenLimit(ctx, req.Storage, client); err != nil {
+		if _, ok := err.(*tokenLimitError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
+	if err := b.recordLogin(ctx, req.Storage, client); err != nil {
+		return nil, err
+	}
+
+	if err := b.trackToken(ctx, req, client, auth); err != nil {
+		if _, ok := err.(*tokenLimitError); ok {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return nil, err
+	}
+
+	return &logical.Response{
+		Auth: auth,
 	}, nil
 }
 
+// roleError is returned when the role of a login doesn't exist or the node
+// doesn't satisfy its bound constraints.
+type roleError struct {
+	err error
+}
+
+func (e *roleError) Error() string {
+	return e.err.Error()
+}
+
+// roleForNode loads the named role and verifies that the client's node
+// satisfies its bound constraints.
+func (b *backend) roleForNode(ctx context.Context, req *logical.Request, roleName string, client string, loader *nodeLoader) (*RoleEntry, error) {
+	role, err := b.Role(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, &roleError{err: fmt.Errorf("role %q not found", roleName)}
+	}
+
+	node, err := loader.get()
+	if err != nil {
+		return nil, err
+	}
+	chefRoles, err := loader.roles()
+	if err != nil {
+		return nil, err
+	}
+	if err := role.validateNode(client, node, chefRoles); err != nil {
+		return nil, &roleError{err: err}
+	}
+
+	// Grants from mappings don't apply to role logins but denials do
+	mappings, err := b.nodeMappings(ctx, req, client, loader)
+	if err != nil {
+		return nil, err
+	}
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	base := &policyMapping{
+		Kind:     "role",
+		Name:     roleName,
+		Policies: role.TokenPolicies,
+	}
+	role.TokenPolicies, err = resolvePolicies(config, base, mappings, false, loader)
+	if err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
 func (b *backend) pathLoginRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	if req.Auth == nil {
 		return nil, fmt.Errorf("request auth was nil")
 	}
 
-	reqPath := req.Auth.InternalData["request_path"].(string)
-	sig := req.Auth.InternalData["signature"].(string)
-	sigVer := req.Auth.InternalData["signature_version"].(string)
 	client := req.Auth.InternalData["client_name"].(string)
-	ts := req.Auth.InternalData["timestamp"].(string)
 
+	if err := b.checkQuarantine(ctx, req.Storage, client); err != nil {
+		return nil, err
+	}
+
+	// The client must still exist and still have the key it logged in with
 	keys, err := b.retrievePubKey(ctx, req, client)
 	if err != nil {
 		return nil, err
 	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("client %q no longer exists or has no valid keys", client)
+	}
+	if fingerprint, ok := req.Auth.InternalData["key_fingerprint"].(string); ok {
+		found := false
+		for _, k := range keys {
+			fp, err := keyFingerprint(k)
+			if err != nil {
+				return nil, err
+			}
+			if fp == fingerprint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("the key client %q logged in with is no longer valid", client)
+		}
+	} else {
+		// Tokens issued before key fingerprints were recorded still carry
+		// the original login signature
+		reqPath, _ := req.Auth.InternalData["request_path"].(string)
+		sig, _ := req.Auth.InternalData["signature"].(string)
+		sigVer, _ := req.Auth.InternalData["signature_version"].(string)
+		ts, _ := req.Auth.InternalData["timestamp"].(string)
+		_, _, clientName := splitClient(client)
+		if !authenticate(clientName, ts, sig, sigVer, keys, reqPath) {
+			return nil, fmt.Errorf("couldn't authenticate renew request")
+		}
+	}
+
+	var resp *logical.Response
+	if roleName, ok := req.Auth.InternalData["role"].(string); ok && roleName != "" {
+		role, err := b.roleForNode(ctx, req, roleName, client, b.nodeLoader(ctx, req, client))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't renew with role %q: %s", roleName, err)
+		}
+		resp, err = b.renewWithPolicies(ctx, req, d, client, role.TokenPolicies, role.TTL, role.MaxTTL)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		policies, err := b.getNodePolicies(ctx, req, client)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't retrieve current policy list: %s", err)
+		}
+		resp, err = b.renewWithPolicies(ctx, req, d, client, policies, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.trackRenewal(ctx, req, client, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
 
-	auth := authenticate(client, ts, sig, sigVer, keys, reqPath)
-	if !auth {
-		return nil, fmt.Errorf("couldn't authenticate renew request")
+// renewWithPolicies extends the token's lease after comparing its policies with
+// the node's current policies according to renewal_policy_change.
+func (b *backend) renewWithPolicies(ctx context.Context, req *logical.Request, d *framework.FieldData, client string, current []string, ttl, maxTTL time.Duration) (*logical.Response, error) {
+	if policyutil.EquivalentPolicies(current, req.Auth.Policies) {
+		return framework.LeaseExtend(ttl, maxTTL, b.System())(ctx, req, d)
 	}
 
-	policies, err := b.getNodePolicies(ctx, req, client)
+	config, err := b.Config(ctx, req.Storage)
 	if err != nil {
-		return nil, fmt.Errorf("coulnd't retrieve current policy list")
+		return nil, err
 	}
 
-	if !policyutil.EquivalentPolicies(policies, req.Auth.Policies) {
-		return nil, fmt.Errorf("policies have changed, not renewing")
+	// The default policy is ignored the same way EquivalentPolicies does
+	added := policyDifference(current, append([]string{"default"}, req.Auth.Policies...))
+	removed := policyDifference(req.Auth.Policies, append([]string{"default"}, current...))
+	change := fmt.Sprintf("policies of client %q have changed since login, added: [%s], removed: [%s]",
+		client, strings.Join(added, ","), strings.Join(removed, ","))
+
+	switch config.RenewalPolicyChange {
+	case "allow":
+	case "allow_subset":
+		if len(removed) > 0 {
+			return nil, fmt.Errorf("%s, not renewing", change)
+		}
+	default:
+		return nil, fmt.Errorf("%s, not renewing", change)
 	}
 
-	return framework.LeaseExtend(0, 0, b.System())(ctx, req, d)
+	b.Logger().Warn("chef-node: renewing token with outdated policies", "client", client, "added", added, "removed", removed)
+	resp, err := framework.LeaseExtend(ttl, maxTTL, b.System())(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+	resp.AddWarning(change + ", the token keeps its original policies")
+	return resp, nil
 }
 
 func constructAuthorization(h http.Header) string {
@@ -169,65 +420,25 @@ func constructAuthorization(h http.Header) string {
 	return ret.String()
 }
 
-func (b *backend) getNodePolicies(ctx context.Context, req *logical.Request, node string) ([]string, error) {
-	var clientPols []string
-	clientEntry, err := b.Client(ctx, req.Storage, node)
-	if err != nil {
-		return nil, err
-	}
-	if clientEntry != nil {
-		clientPols = clientEntry.Policies
-	}
-	config, err := b.Config(ctx, req.Storage)
-	if err != nil {
-		return nil, err
-	}
-	defaultPols := config.DefaultPolicies
-	var allPol []string
-	allPol = append(allPol, clientPols...)
-	allPol = append(allPol, defaultPols...)
-	allPol = strutil.RemoveDuplicates(allPol, false)
-
-	return allPol, nil
-}
-
-func (b *backend) retrievePubKey(ctx context.Context, req *logical.Request, targetName string) ([]*rsa.PublicKey, error) {
+// retrievePubKey fetches the unexpired keys of the client from the client's
+// Chef server.
+func (b *backend) retrievePubKey(ctx context.Context, req *logical.Request, name string) ([]*rsa.PublicKey, error) {
 	var keys []*rsa.PublicKey
-	config, err := b.Config(ctx, req.Storage)
-	if err != nil {
-		return nil, err
-	}
-
-	keysURL, err := url.Parse(config.BaseURL + "/clients/" + targetName + "/keys")
-	if err != nil {
-		return nil, err
-	}
-
-	headers, err := authHeaders(config, keysURL, "GET", nil, true)
-	if err != nil {
-		return nil, err
-	}
-
-	clientReq, err := http.NewRequest("GET", keysURL.String(), nil)
+	server, org, targetName := splitClient(name)
+	config, err := b.serverConfig(ctx, req.Storage, server)
 	if err != nil {
 		return nil, err
 	}
 
-	clientReq.Header = headers
-	client := &http.Client{}
-	resp, err := client.Do(clientReq)
-	if err != nil {
-		return nil, err
+	var kr []keyInfo
+	err = b.getChefObject(config, org, "/clients/"+targetName+"/keys", &kr)
+	// A client that doesn't exist has no keys to authenticate with
+	if isNotFound(err) {
+		return nil, nil
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	var kr []keyInfo
-	if err := json.Unmarshal(body, &kr); err != nil {
-		return nil, fmt.Errorf("Couldn't unmarshal '%s' into keyInfo", body)
-	}
 	for i := range kr {
 		if kr[i].Expired {
 			continue
@@ -237,37 +448,18 @@ func (b *backend) retrievePubKey(ctx context.Context, req *logical.Request, targ
 			return nil, err
 		}
 
-		keyHeaders, err := authHeaders(config, keyURL, "GET", nil, true)
-		if err != nil {
+		// The key is fetched by name rather than from its URI, which names
+		// whichever endpoint the Chef server considers its own
+		var ck keyResponse
+		keyPath := "/clients/" + targetName + "/keys/" + path.Base(keyURL.Path)
+		if err := b.getChefObject(config, org, keyPath, &ck); err != nil {
 			return nil, err
 		}
 
-		keyReq, err := http.NewRequest("GET", keyURL.String(), nil)
-		if err != nil {
-			return nil, err
-		}
-
-		keyReq.Header = keyHeaders
-		keyClient := &http.Client{}
-		keyResp, err := keyClient.Do(keyReq)
-		if err != nil {
-			return nil, err
-		}
-		defer keyResp.Body.Close()
-		keyBody, err := ioutil.ReadAll(keyResp.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		var ck struct {
-			ClientKey string `json:"public_key"`
-		}
-		err = json.Unmarshal(keyBody, &ck)
+		cKey, err := parsePublicKey(ck.ClientKey)
 		if err != nil {
 			return nil, err
 		}
-
-		cKey, err := parsePublicKey(ck.ClientKey)
 		keys = append(keys, cKey)
 	}
 
@@ -275,6 +467,12 @@ func (b *backend) retrievePubKey(ctx context.Context, req *logical.Request, targ
 }
 
 func authenticate(client string, ts string, sig string, sigVer string, keys []*rsa.PublicKey, path string) bool {
+	return verifyingKey(client, ts, sig, sigVer, keys, path) != nil
+}
+
+// verifyingKey returns the key that the login signature was made with, or nil
+// if none of the keys match.
+func verifyingKey(client string, ts string, sig string, sigVer string, keys []*rsa.PublicKey, path string) *rsa.PublicKey {
 	bodyHash := sha1.Sum([]byte(""))
 	hashedPath := sha1.Sum([]byte(path))
 	headers := []string{
@@ -287,15 +485,15 @@ func authenticate(client string, ts string, sig string, sigVer string, keys []*r
 	headerString := strings.Join(headers, "\n")
 	decSig, err := base64.StdEncoding.DecodeString(sig)
 	if err != nil {
-		return false
+		return nil
 	}
 	for i := range keys {
 		err = rsa.VerifyPKCS1v15(keys[i], crypto.Hash(0), []byte(headerString), decSig)
 		if err == nil {
-			return true
+			return keys[i]
 		}
 	}
-	return false
+	return nil
 }
 
 func authHeaders(conf *config, url *url.URL, method string, body io.Reader, split bool) (http.Header, error) {
@@ -374,6 +572,16 @@ func parsePublicKey(key string) (*rsa.PublicKey, error) {
 	return pubkey.(*rsa.PublicKey), nil
 }
 
+// keyFingerprint returns the hex encoded SHA-256 hash of the DER encoded key.
+func keyFingerprint(key *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 type keyInfo struct {
 	URI     string `json:"uri"`
 	Expired bool   `json:"expired"`
@@ -0,0 +1,290 @@
+package chefnode
+
+import (
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathPendingList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "pending/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathPendingList,
+		},
+		HelpSynopsis:    pathPendingHelpSyn,
+		HelpDescription: pathPendingHelpDesc,
+	}
+}
+
+func pathPending(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `pending/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client",
+			},
+			"action": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Either "approve" to create a client mapping and allow the client to
+log in, or "reject" to remove the client from the queue.`,
+			},
+			"policies": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Comma-seperated list of policies of the client mapping created on approval.",
+			},
+			"description": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Description of the client mapping created on approval",
+			},
+			"owner": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Owner of the client mapping created on approval",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathPendingRead,
+			logical.UpdateOperation: b.pathPendingWrite,
+			logical.DeleteOperation: b.pathPendingDelete,
+		},
+		HelpSynopsis:    pathPendingHelpSyn,
+		HelpDescription: pathPendingHelpDesc,
+	}
+}
+
+// PendingClientEntry is a Chef client whose login is waiting for approval.
+type PendingClientEntry struct {
+	KeyFingerprint string                 `json:"key_fingerprint"`
+	SourceIP       string                 `json:"source_ip"`
+	Node           map[string]interface{} `json:"node"`
+	FirstSeen      time.Time              `json:"first_seen"`
+	LastSeen       time.Time              `json:"last_seen"`
+	Attempts       int                    `json:"attempts"`
+}
+
+// requiresApproval returns whether the client must be approved before it can
+// log in. When require_approval is set, that is the case for clients that have
+// never logged in and have no client mapping. Environment, Chef role and client
+// pattern mappings don't count, since a new node chooses its own environment
+// and roles, and patterns can match any name.
+func (b *backend) requiresApproval(ctx context.Context, req *logical.Request, client string) (bool, error) {
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return false, err
+	}
+	if !config.RequireApproval {
+		return false, nil
+	}
+
+	seen, err := req.Storage.Get(ctx, "seen/"+client)
+	if err != nil {
+		return false, err
+	}
+	if seen != nil {
+		return false, nil
+	}
+
+	entry, err := b.Client(ctx, req.Storage, client)
+	if err != nil {
+		return false, err
+	}
+	return entry == nil, nil
+}
+
+// queuePendingClient adds the client to the pending queue, or records another
+// attempt if it is already queued.
+func (b *backend) queuePendingClient(ctx context.Context, req *logical.Request, client string, key *rsa.PublicKey) error {
+	pending, err := b.PendingClient(ctx, req.Storage, client)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if pending == nil {
+		pending = &PendingClientEntry{
+			FirstSeen: now,
+		}
+	}
+	pending.LastSeen = now
+	pending.Attempts++
+
+	pending.KeyFingerprint, err = keyFingerprint(key)
+	if err != nil {
+		return err
+	}
+	if req.Connection != nil {
+		pending.SourceIP = req.Connection.RemoteAddr
+	}
+
+	// The node object may not have been saved yet by a newly bootstrapped
+	// client, so a failure to fetch it isn't an error
+	node, err := b.nodeLoader(ctx, req, client).get()
+	if err == nil {
+		pending.Node = map[string]interface{}{
+			"name":             node.Name,
+			"chef_environment": node.Environment,
+			"run_list":         node.RunList,
+			"policy_name":      node.PolicyName,
+			"policy_group":     node.PolicyGroup,
+		}
+		for _, path := range []string{"fqdn", "platform", "platform_version"} {
+			if v, ok := node.Attribute("automatic." + path); ok {
+				pending.Node[path] = v
+			}
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("pending/"+client, pending)
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) PendingClient(ctx context.Context, s logical.Storage, n string) (*PendingClientEntry, error) {
+	entry, err := s.Get(ctx, "pending/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result PendingClientEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathPendingList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	clients, err := listClients(ctx, req.Storage, "pending/")
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := make(map[string]interface{})
+	for _, name := range clients {
+		pending, err := b.PendingClient(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if pending == nil {
+			continue
+		}
+		keyInfo[name] = map[string]interface{}{
+			"key_fingerprint": pending.KeyFingerprint,
+			"source_ip":       pending.SourceIP,
+			"last_seen":       pending.LastSeen.Format(time.RFC3339),
+		}
+	}
+	return logical.ListResponseWithInfo(clients, keyInfo), nil
+}
+
+func (b *backend) pathPendingRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	pending, err := b.PendingClient(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"key_fingerprint": pending.KeyFingerprint,
+			"source_ip":       pending.SourceIP,
+			"node":            pending.Node,
+			"first_seen":      pending.FirstSeen.Format(time.RFC3339),
+			"last_seen":       pending.LastSeen.Format(time.RFC3339),
+			"attempts":        pending.Attempts,
+		},
+	}, nil
+}
+
+func (b *backend) pathPendingWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	action := d.Get("action").(string)
+	if action != "approve" && action != "reject" {
+		return logical.ErrorResponse(`action must be "approve" or "reject"`), nil
+	}
+
+	pending, err := b.PendingClient(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return logical.ErrorResponse(fmt.Sprintf("client %q is not pending approval", name)), nil
+	}
+
+	if action == "reject" {
+		return b.pathPendingDelete(ctx, req, d)
+	}
+
+	// The mapping only accepts the key that was reviewed, so that a client
+	// that took over the name after it was queued can't use the approval
+	client := &ClientEntry{
+		Policies:       policyutil.ParsePolicies(d.Get("policies").(string)),
+		Description:    d.Get("description").(string),
+		Owner:          d.Get("owner").(string),
+		KeyFingerprint: pending.KeyFingerprint,
+	}
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateMapping(client.Policies, nil); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	b.clientLock.Lock()
+	defer b.clientLock.Unlock()
+
+	// Never overwrite a mapping that was created since the client was queued
+	cas := 0
+	version, err := b.putClientVersion(ctx, req.Storage, name, client, &cas)
+	if err != nil {
+		if _, ok := err.(*casError); ok {
+			return logical.ErrorResponse(fmt.Sprintf("client %q already has a client mapping", name)), nil
+		}
+		return nil, err
+	}
+
+	if err := req.Storage.Delete(ctx, "pending/"+name); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": version,
+		},
+	}, nil
+}
+
+func (b *backend) pathPendingDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, "pending/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+const pathPendingHelpSyn = `
+Approve or reject Chef clients waiting for their first login
+`
+const pathPendingHelpDesc = `
+When require_approval is set in the config, the first login of a Chef client that has
+never logged in and has no client mapping is refused, even if an environment, Chef role
+or client pattern mapping applies to it. The client is queued here along with its key
+fingerprint, source IP and a summary of its node. Approving a client creates its client
+mapping with the given policies, pinned to the queued key fingerprint so that the
+client can only log in with the key that was reviewed. Rejecting a client, or deleting
+it, removes it from the queue; its next login queues it again.
+`
@@ -0,0 +1,196 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathQuarantinesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "quarantines/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathQuarantineList,
+		},
+		HelpSynopsis:    pathQuarantineHelpSyn,
+		HelpDescription: pathQuarantineHelpDesc,
+	}
+}
+
+func pathQuarantines(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `quarantine/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef client",
+			},
+			"reason": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Reason the client is quarantined",
+			},
+			"expires_at": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `RFC 3339 timestamp after which the quarantine is lifted. If empty,
+the quarantine lasts until it is deleted.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathQuarantineDelete,
+			logical.ReadOperation:   b.pathQuarantineRead,
+			logical.UpdateOperation: b.pathQuarantineWrite,
+		},
+		HelpSynopsis:    pathQuarantineHelpSyn,
+		HelpDescription: pathQuarantineHelpDesc,
+	}
+}
+
+// quarantinedError is returned when a quarantined client tries to log in or
+// renew a token.
+type quarantinedError struct {
+	client string
+}
+
+func (e *quarantinedError) Error() string {
+	return fmt.Sprintf("client %q is quarantined", e.client)
+}
+
+// checkQuarantine returns a quarantinedError if the client is under an active
+// quarantine.
+func (b *backend) checkQuarantine(ctx context.Context, s logical.Storage, client string) error {
+	q, err := b.Quarantine(ctx, s, client)
+	if err != nil {
+		return err
+	}
+	if q != nil && q.active(time.Now()) {
+		return &quarantinedError{client: client}
+	}
+	return nil
+}
+
+func (b *backend) Quarantine(ctx context.Context, s logical.Storage, n string) (*QuarantineEntry, error) {
+	entry, err := s.Get(ctx, "quarantine/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result QuarantineEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathQuarantineList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := listClients(ctx, req.Storage, "quarantine/")
+	if err != nil {
+		return nil, err
+	}
+
+	// Only active quarantines are listed
+	now := time.Now()
+	var clients []string
+	keyInfo := make(map[string]interface{})
+	for _, name := range names {
+		q, err := b.Quarantine(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if q == nil || !q.active(now) {
+			continue
+		}
+		clients = append(clients, name)
+		keyInfo[name] = q.data()
+	}
+	return logical.ListResponseWithInfo(clients, keyInfo), nil
+}
+
+func (b *backend) pathQuarantineRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	q, err := b.Quarantine(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if q == nil {
+		return nil, nil
+	}
+
+	data := q.data()
+	data["active"] = q.active(time.Now())
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+func (b *backend) pathQuarantineWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	q := &QuarantineEntry{
+		Reason:    d.Get("reason").(string),
+		CreatedAt: time.Now().UTC(),
+	}
+	if raw := d.Get("expires_at").(string); raw != "" {
+		expiresAt, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("couldn't parse expires_at: %s", err)), nil
+		}
+		q.ExpiresAt = expiresAt.UTC()
+	}
+
+	entry, err := logical.StorageEntryJSON("quarantine/"+d.Get("name").(string), q)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathQuarantineDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, "quarantine/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+type QuarantineEntry struct {
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// active returns whether the quarantine is still in effect at the given time.
+func (q *QuarantineEntry) active(now time.Time) bool {
+	return q.ExpiresAt.IsZero() || now.Before(q.ExpiresAt)
+}
+
+func (q *QuarantineEntry) data() map[string]interface{} {
+	expiresAt := ""
+	if !q.ExpiresAt.IsZero() {
+		expiresAt = q.ExpiresAt.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"reason":     q.Reason,
+		"created_at": q.CreatedAt.Format(time.RFC3339),
+		"expires_at": expiresAt,
+	}
+}
+
+const pathQuarantineHelpSyn = `
+Block a Chef client from logging in or renewing tokens
+`
+const pathQuarantineHelpDesc = `
+A quarantined client can't log in, and tokens that were issued to it can't be renewed,
+until the quarantine expires or is deleted. The Chef client itself is left untouched.
+Listing quarantines returns only the ones that are still in effect. Logins are checked
+against the quarantine once their signature is verified, so that the quarantine and its
+reason are only revealed to the client itself.
+`
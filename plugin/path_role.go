@@ -0,0 +1,222 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathRolesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathRoleList,
+		},
+		HelpSynopsis:    pathRoleHelpSyn,
+		HelpDescription: pathRoleHelpDesc,
+	}
+}
+
+func pathRoles(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `role/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the role",
+			},
+			"bound_environments": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of Chef environments. If set, the node must
+be in one of these environments to log in with this role. Environments of a named Chef
+server or an organization are qualified as <server>:<organization>/<environment>.`,
+			},
+			"bound_chef_roles": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of Chef roles. If set, the node must have
+at least one of these roles in its expanded run list to log in with this role. Roles of
+a named Chef server or an organization are qualified as <server>:<organization>/<role>.`,
+			},
+			"bound_policy_groups": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of Chef policy groups. If set, the node must
+be in one of these policy groups to log in with this role. Policy groups of a named Chef
+server or an organization are qualified as <server>:<organization>/<policy_group>.`,
+			},
+			"bound_client_names": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of Chef client names. Globs are supported.
+If set, the client name must match one of these to log in with this role.`,
+			},
+			"token_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma-seperated list of policies issued to tokens created with this role.
+Policy names may contain templates that are rendered against the node object at login.
+Nodes can set most of their own attributes, so a template lets a node choose part of
+its policy name.`,
+			},
+			"ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "TTL of tokens issued with this role. Defaults to the mount's TTL.",
+			},
+			"max_ttl": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: "Maximum TTL of tokens issued with this role. Defaults to the mount's max TTL.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathRoleDelete,
+			logical.ReadOperation:   b.pathRoleRead,
+			logical.UpdateOperation: b.pathRoleWrite,
+		},
+		HelpSynopsis:    pathRoleHelpSyn,
+		HelpDescription: pathRoleHelpDesc,
+	}
+}
+
+func (b *backend) pathRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, "role/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(roles), nil
+}
+
+func (b *backend) Role(ctx context.Context, s logical.Storage, n string) (*RoleEntry, error) {
+	entry, err := s.Get(ctx, "role/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result RoleEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, "role/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.Role(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"bound_environments":  role.BoundEnvironments,
+			"bound_chef_roles":    role.BoundChefRoles,
+			"bound_policy_groups": role.BoundPolicyGroups,
+			"bound_client_names":  role.BoundClientNames,
+			"token_policies":      role.TokenPolicies,
+			"ttl":                 int64(role.TTL.Seconds()),
+			"max_ttl":             int64(role.MaxTTL.Seconds()),
+		},
+	}, nil
+}
+
+func (b *backend) pathRoleWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role := &RoleEntry{
+		BoundEnvironments: strutil.ParseDedupAndSortStrings(d.Get("bound_environments").(string), ","),
+		BoundChefRoles:    strutil.ParseDedupAndSortStrings(d.Get("bound_chef_roles").(string), ","),
+		BoundPolicyGroups: strutil.ParseDedupAndSortStrings(d.Get("bound_policy_groups").(string), ","),
+		BoundClientNames:  strutil.ParseDedupAndSortStrings(d.Get("bound_client_names").(string), ","),
+		TokenPolicies:     policyutil.ParsePolicies(d.Get("token_policies").(string)),
+		TTL:               time.Duration(d.Get("ttl").(int)) * time.Second,
+		MaxTTL:            time.Duration(d.Get("max_ttl").(int)) * time.Second,
+	}
+	if role.MaxTTL > 0 && role.TTL > role.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+	if err := validatePolicyTemplates(role.TokenPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.checkPolicies(role.TokenPolicies); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	entry, err := logical.StorageEntryJSON("role/"+d.Get("name").(string), role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// validateNode checks that the client and its node satisfy every bound
+// constraint configured on the role. chefRoles is the node's expanded role list.
+func (r *RoleEntry) validateNode(client string, node *chefNode, chefRoles []string) error {
+	if len(r.BoundClientNames) > 0 && !strutil.StrListContainsGlob(r.BoundClientNames, client) {
+		return fmt.Errorf("client %q is not allowed by role", client)
+	}
+	// Node values are qualified with the node's server and organization the
+	// same way as client names, so that bounds don't match nodes elsewhere
+	env := qualifyClient(node.server, node.org, node.Environment)
+	if len(r.BoundEnvironments) > 0 && !strutil.StrListContains(r.BoundEnvironments, env) {
+		return fmt.Errorf("environment %q is not allowed by role", env)
+	}
+	policyGroup := qualifyClient(node.server, node.org, node.PolicyGroup)
+	if len(r.BoundPolicyGroups) > 0 && !strutil.StrListContains(r.BoundPolicyGroups, policyGroup) {
+		return fmt.Errorf("policy group %q is not allowed by role", policyGroup)
+	}
+	if len(r.BoundChefRoles) > 0 {
+		found := false
+		for _, role := range chefRoles {
+			if strutil.StrListContains(r.BoundChefRoles, qualifyClient(node.server, node.org, role)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("node has none of the chef roles required by role")
+		}
+	}
+	return nil
+}
+
+type RoleEntry struct {
+	BoundEnvironments []string      `json:"bound_environments"`
+	BoundChefRoles    []string      `json:"bound_chef_roles"`
+	BoundPolicyGroups []string      `json:"bound_policy_groups"`
+	BoundClientNames  []string      `json:"bound_client_names"`
+	TokenPolicies     []string      `json:"token_policies"`
+	TTL               time.Duration `json:"ttl"`
+	MaxTTL            time.Duration `json:"max_ttl"`
+}
+
+const pathRoleHelpSyn = `
+Manage Vault login roles bound to Chef node attributes
+`
+const pathRoleHelpDesc = `
+This endpoint allows you to create, read, update, and delete login roles. A node that
+logs in with a role receives only the role's token policies, and only if it satisfies
+every bound constraint configured on the role.
+`
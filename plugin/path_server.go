@@ -0,0 +1,267 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/helper/policyutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathServersList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "servers/?$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathServerList,
+		},
+		HelpSynopsis:    pathServerHelpSyn,
+		HelpDescription: pathServerHelpDesc,
+	}
+}
+
+func pathServers(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `server/(?P<name>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the Chef server",
+			},
+			"base_url": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `The URL to the chef server api endpoint`,
+			},
+			"failover_urls": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of URLs of other endpoints of the same Chef
+server, tried in order when base_url fails.`,
+			},
+			"client_name": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Name of the client to connect to chef server with. This needs
+to be precreated in the chef server.`,
+			},
+			"client_key": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `PEM encoded client key to use for authenticating to chef
+server. This is generated when the client is created in the chef server`,
+			},
+			"default_policies": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of policies given to all tokens of clients of
+this Chef server. They replace the default_policies of the config.`,
+			},
+			"client_prefixes": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Comma seperated list of client name prefixes. Logins without a server
+parameter from clients whose name starts with one of them are routed to this server.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathServerDelete,
+			logical.ReadOperation:   b.pathServerRead,
+			logical.UpdateOperation: b.pathServerWrite,
+		},
+		HelpSynopsis:    pathServerHelpSyn,
+		HelpDescription: pathServerHelpDesc,
+	}
+}
+
+// serverNotFoundError is returned when a Chef server isn't configured.
+type serverNotFoundError struct {
+	server string
+}
+
+func (e *serverNotFoundError) Error() string {
+	return fmt.Sprintf("chef server %q not found", e.server)
+}
+
+// serverConfig returns the config used to talk to the named Chef server, which
+// is the config itself with the connection settings and default policies of
+// the server. An empty name refers to the server in the config.
+func (b *backend) serverConfig(ctx context.Context, s logical.Storage, name string) (*config, error) {
+	config, err := b.Config(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return config, nil
+	}
+
+	server, err := b.Server(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, &serverNotFoundError{server: name}
+	}
+	config.BaseURL = server.BaseURL
+	config.ClientName = server.ClientName
+	config.FailoverURLs = server.FailoverURLs
+	config.ClientKey = server.ClientKey
+	config.DefaultPolicies = server.DefaultPolicies
+	return config, nil
+}
+
+// selectServer returns the name of the server a login is for. Without an
+// explicit server, the server with the longest client prefix matching the
+// client is used, or the server in the config if none match.
+func (b *backend) selectServer(ctx context.Context, s logical.Storage, requested string, client string) (string, error) {
+	if requested != "" {
+		server, err := b.Server(ctx, s, requested)
+		if err != nil {
+			return "", err
+		}
+		if server == nil {
+			return "", &serverNotFoundError{server: requested}
+		}
+		return requested, nil
+	}
+
+	names, err := s.List(ctx, "server/")
+	if err != nil {
+		return "", err
+	}
+	selected := ""
+	longest := 0
+	for _, name := range names {
+		server, err := b.Server(ctx, s, name)
+		if err != nil {
+			return "", err
+		}
+		if server == nil {
+			continue
+		}
+		for _, prefix := range server.ClientPrefixes {
+			if len(prefix) > longest && strings.HasPrefix(client, prefix) {
+				selected = name
+				longest = len(prefix)
+			}
+		}
+	}
+	return selected, nil
+}
+
+func (b *backend) pathServerList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	servers, err := req.Storage.List(ctx, "server/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(servers), nil
+}
+
+func (b *backend) Server(ctx context.Context, s logical.Storage, n string) (*ServerEntry, error) {
+	entry, err := s.Get(ctx, "server/"+n)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result ServerEntry
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathServerDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete(ctx, "server/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	b.resetRoleCache()
+
+	return nil, nil
+}
+
+func (b *backend) pathServerRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	server, err := b.Server(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: structs.New(server).Map(),
+	}
+	resp.AddWarning("Read access to this endpoint should be controlled via ACLs as it will return the configuration information as-is, including any passwords.")
+	return resp, nil
+}
+
+func (b *backend) pathServerWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	if strings.ContainsAny(name, ":/") {
+		return logical.ErrorResponse("server names can't contain ':' or '/'"), nil
+	}
+
+	server := &ServerEntry{
+		BaseURL:         d.Get("base_url").(string),
+		FailoverURLs:    strutil.ParseStringSlice(d.Get("failover_urls").(string), ","),
+		ClientName:      d.Get("client_name").(string),
+		ClientKey:       d.Get("client_key").(string),
+		DefaultPolicies: policyutil.ParsePolicies(d.Get("default_policies").(string)),
+		ClientPrefixes:  strutil.ParseDedupAndSortStrings(d.Get("client_prefixes").(string), ","),
+	}
+
+	if _, err := parsePrivateKey(server.ClientKey); err != nil {
+		return nil, err
+	}
+	for _, u := range append([]string{server.BaseURL}, server.FailoverURLs...) {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.validateMapping(server.DefaultPolicies, nil); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	entry, err := logical.StorageEntryJSON("server/"+name, server)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	b.resetRoleCache()
+
+	return nil, nil
+}
+
+type ServerEntry struct {
+	BaseURL         string   `json:"base_url" structs:"base_url"`
+	FailoverURLs    []string `json:"failover_urls" structs:"failover_urls"`
+	ClientName      string   `json:"client_name" structs:"client_name"`
+	ClientKey       string   `json:"client_key" structs:"client_key"`
+	DefaultPolicies []string `json:"default_policies" structs:"default_policies"`
+	ClientPrefixes  []string `json:"client_prefixes" structs:"client_prefixes"`
+}
+
+const pathServerHelpSyn = `
+Configure additional Chef servers
+`
+const pathServerHelpDesc = `
+Each server has its own URL, credentials and default policies, which replace those of
+the config for clients of that server. A login is for the server named by its server
+parameter, or else for the server whose client_prefixes match the client name, or else
+for the server in the config. The mappings of a client of a named server are stored
+under <server>:<client>, or <server>:<organization>/<client> for a client of an
+organization, so they can't collide with a client of the same name on another server.
+Environment, Chef role and client pattern mappings of a named server are likewise
+written to environment/<server>:<environment>, chef_role/<server>:<role> and
+client_pattern/<server>:<name>, and only apply to its clients.
+`
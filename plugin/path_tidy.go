@@ -0,0 +1,333 @@
+package chefnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// defaultTidyGracePeriod is used when tidy_grace_period isn't configured.
+const defaultTidyGracePeriod = 72 * time.Hour
+
+func pathTidy(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy$",
+		Fields: map[string]*framework.FieldSchema{
+			"remove": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, client mappings whose Chef client has been missing for longer
+than the grace period are deleted. Otherwise they are only reported.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathTidy,
+		},
+		HelpSynopsis:    pathTidyHelpSyn,
+		HelpDescription: pathTidyHelpDesc,
+	}
+}
+
+func pathTidyStatus(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy/status$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathTidyStatusRead,
+		},
+		HelpSynopsis:    pathTidyStatusHelpSyn,
+		HelpDescription: pathTidyStatusHelpDesc,
+	}
+}
+
+// tidyStatus is the result of the last tidy run. Missing is kept between runs
+// so that the grace period can be measured from when a Chef client was first
+// found to be missing.
+type tidyStatus struct {
+	LastRunStart time.Time            `json:"last_run_start"`
+	LastRunEnd   time.Time            `json:"last_run_end"`
+	Removing     bool                 `json:"removing"`
+	Checked      int                  `json:"checked"`
+	Missing      map[string]time.Time `json:"missing"`
+	Removed      []string             `json:"removed"`
+	Error        string               `json:"error"`
+}
+
+func (b *backend) tidyStatus(ctx context.Context, s logical.Storage) (*tidyStatus, error) {
+	entry, err := s.Get(ctx, "tidy_status")
+	if err != nil {
+		return nil, err
+	}
+
+	result := tidyStatus{
+		Missing: make(map[string]time.Time),
+	}
+	if entry != nil {
+		if err := entry.DecodeJSON(&result); err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+// periodicTidy runs tidyClients once tidy_interval has passed since the last
+// run. It does nothing if tidy_interval isn't configured.
+func (b *backend) periodicTidy(ctx context.Context, req *logical.Request) error {
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if config.TidyInterval <= 0 || config.BaseURL == "" {
+		return nil
+	}
+	status, err := b.tidyStatus(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if time.Since(status.LastRunStart) < config.TidyInterval {
+		return nil
+	}
+
+	_, err = b.tidyClients(ctx, req.Storage, config.TidyRemove)
+	if err == errTidyRunning {
+		return nil
+	}
+	return err
+}
+
+var errTidyRunning = errors.New("tidy is already running")
+
+// tidyChanged reports whether the mapping was written, approved or deleted, or
+// its client logged in, since the tidy run started. It must be called with
+// clientLock held.
+func (b *backend) tidyChanged(ctx context.Context, s logical.Storage, name string, version int, start time.Time) (bool, error) {
+	client, err := b.Client(ctx, s, name)
+	if err != nil {
+		return false, err
+	}
+	if client == nil || client.Version != version {
+		return true, nil
+	}
+
+	entry, err := s.Get(ctx, "seen/"+name)
+	if err != nil {
+		return false, err
+	}
+	if entry == nil {
+		return false, nil
+	}
+	var seen seenClientEntry
+	if err := entry.DecodeJSON(&seen); err != nil {
+		return false, err
+	}
+	return seen.LastLogin.After(start), nil
+}
+
+// tidyClients compares the client mappings with the clients that exist on the
+// Chef server. Mappings of missing clients are recorded, and if remove is set
+// deleted once their client has been missing for the grace period.
+func (b *backend) tidyClients(ctx context.Context, s logical.Storage, remove bool) (*tidyStatus, error) {
+	if !atomic.CompareAndSwapInt32(&b.tidyRunning, 0, 1) {
+		return nil, errTidyRunning
+	}
+	defer atomic.StoreInt32(&b.tidyRunning, 0)
+
+	prev, err := b.tidyStatus(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	status := &tidyStatus{
+		LastRunStart: time.Now().UTC(),
+		Removing:     remove,
+		Missing:      make(map[string]time.Time),
+		Removed:      []string{},
+	}
+
+	err = func() error {
+		config, err := b.Config(ctx, s)
+		if err != nil {
+			return err
+		}
+		grace := config.TidyGracePeriod
+		if grace <= 0 {
+			grace = defaultTidyGracePeriod
+		}
+
+		names, err := listClients(ctx, s, "client/")
+		if err != nil {
+			return err
+		}
+		status.Checked = len(names)
+
+		// The versions are recorded before fetching any client list, so that
+		// a mapping written or approved after its client was found missing
+		// isn't deleted
+		versions := make(map[string]int)
+		for _, name := range names {
+			client, err := b.Client(ctx, s, name)
+			if err != nil {
+				return err
+			}
+			if client != nil {
+				versions[name] = client.Version
+			}
+		}
+
+		// Each mapping is checked against the clients of its own Chef server
+		// and organization. The client lists are fetched before taking the
+		// lock so that logins and mapping writes don't wait on the Chef server.
+		chefClients := make(map[string]map[string]string)
+		var due []string
+		for _, name := range names {
+			server, org, client := splitClient(name)
+			scope := qualifyClient(server, org, "")
+			if _, ok := chefClients[scope]; !ok {
+				clients, err := b.listChefClients(ctx, s, server, org)
+				if err != nil {
+					return err
+				}
+				chefClients[scope] = clients
+			}
+			if _, ok := chefClients[scope][client]; ok {
+				continue
+			}
+			firstMissing, ok := prev.Missing[name]
+			if !ok {
+				firstMissing = status.LastRunStart
+			}
+			if !remove || status.LastRunStart.Sub(firstMissing) < grace {
+				status.Missing[name] = firstMissing
+				continue
+			}
+			due = append(due, name)
+		}
+		if len(due) == 0 {
+			return nil
+		}
+
+		b.clientLock.Lock()
+		defer b.clientLock.Unlock()
+
+		for _, name := range due {
+			stale, err := b.tidyChanged(ctx, s, name, versions[name], status.LastRunStart)
+			if err != nil {
+				return err
+			}
+			if stale {
+				continue
+			}
+			if err := b.deleteClient(ctx, s, name); err != nil {
+				return err
+			}
+			if err := s.Delete(ctx, "seen/"+name); err != nil {
+				return err
+			}
+			status.Removed = append(status.Removed, name)
+		}
+		return nil
+	}()
+	if err != nil {
+		// Keep tracking the clients that were already known to be missing
+		status.Missing = prev.Missing
+		status.Error = err.Error()
+	}
+	status.LastRunEnd = time.Now().UTC()
+
+	entry, putErr := logical.StorageEntryJSON("tidy_status", status)
+	if putErr != nil {
+		return nil, putErr
+	}
+	if putErr := s.Put(ctx, entry); putErr != nil {
+		return nil, putErr
+	}
+	return status, err
+}
+
+// listChefClients returns the clients of the Chef server, within the
+// organization if one is given.
+func (b *backend) listChefClients(ctx context.Context, s logical.Storage, server string, org string) (map[string]string, error) {
+	config, err := b.serverConfig(ctx, s, server)
+	if err != nil {
+		return nil, err
+	}
+	var clients map[string]string
+	if err := b.getChefObject(config, org, "/clients", &clients); err != nil {
+		return nil, err
+	}
+	// An empty client list most likely means the backend is pointed at the
+	// wrong organization, so don't treat every mapping as stale
+	if len(clients) == 0 {
+		if server != "" || org != "" {
+			return nil, fmt.Errorf("chef server returned no clients for %q", qualifyClient(server, org, ""))
+		}
+		return nil, fmt.Errorf("chef server returned no clients")
+	}
+	return clients, nil
+}
+
+func (b *backend) pathTidy(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	status, err := b.tidyClients(ctx, req.Storage, d.Get("remove").(bool))
+	if err == errTidyRunning {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: status.data(),
+	}, nil
+}
+
+func (b *backend) pathTidyStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	status, err := b.tidyStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if status.LastRunStart.IsZero() {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: status.data(),
+	}, nil
+}
+
+func (t *tidyStatus) data() map[string]interface{} {
+	missing := make(map[string]interface{})
+	for name, first := range t.Missing {
+		missing[name] = first.Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"last_run_start": t.LastRunStart.Format(time.RFC3339),
+		"last_run_end":   t.LastRunEnd.Format(time.RFC3339),
+		"removing":       t.Removing,
+		"checked":        t.Checked,
+		"missing":        missing,
+		"removed":        t.Removed,
+		"error":          t.Error,
+	}
+}
+
+const pathTidyHelpSyn = `
+Find client mappings whose Chef client no longer exists
+`
+const pathTidyHelpDesc = `
+Lists the clients on the Chef server and reports every client mapping whose Chef client
+is missing, along with when it was first found to be missing. With remove set, mappings
+whose client has been missing for longer than tidy_grace_period are deleted. The same
+check runs periodically if tidy_interval is configured.
+`
+
+const pathTidyStatusHelpSyn = `
+Show the result of the last tidy run
+`
+const pathTidyStatusHelpDesc = `
+Returns when the last tidy run started and finished, how many client mappings were
+checked, the mappings whose Chef client is missing, the mappings that were removed, and
+any error that stopped the run.
+`
@@ -0,0 +1,331 @@
+package chefnode
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// policyMapping is a single configured source of policies that applies to a
+// node, such as its client entry or its environment.
+type policyMapping struct {
+	Kind           string
+	Name           string
+	Policies       []string
+	DeniedPolicies []string
+	DenyLogin      bool
+}
+
+// loginDeniedError is returned when a mapping that applies to the node blocks
+// login entirely.
+type loginDeniedError struct {
+	mapping *policyMapping
+}
+
+func (m *policyMapping) source() string {
+	return m.Kind + ":" + m.Name
+}
+
+func (e *loginDeniedError) Error() string {
+	return fmt.Sprintf("login denied by %s mapping %q", e.mapping.Kind, e.mapping.Name)
+}
+
+// unrenderedDenialError is returned when a templated denied policy can't be
+// rendered against the node. Dropping the denial would grant whatever it was
+// meant to remove, so login is refused instead.
+type unrenderedDenialError struct {
+	source string
+	policy string
+}
+
+func (e *unrenderedDenialError) Error() string {
+	return fmt.Sprintf("login denied: denied policy %q from %s could not be rendered", e.policy, e.source)
+}
+
+// nodeMappings returns every mapping that applies to the client.
+func (b *backend) nodeMappings(ctx context.Context, req *logical.Request, client string, node *nodeLoader) ([]*policyMapping, error) {
+	var mappings []*policyMapping
+
+	clientEntry, err := b.Client(ctx, req.Storage, client)
+	if err != nil {
+		return nil, err
+	}
+	if clientEntry != nil && clientEntry.Disabled {
+		// A disabled client can't log in, even once its mapping has expired
+		mappings = append(mappings, &policyMapping{
+			Kind:      "client",
+			Name:      client,
+			DenyLogin: true,
+		})
+	} else if clientEntry != nil && !clientEntry.expired(time.Now()) {
+		mappings = append(mappings, &policyMapping{
+			Kind:           "client",
+			Name:           client,
+			Policies:       clientEntry.Policies,
+			DeniedPolicies: clientEntry.DeniedPolicies,
+			DenyLogin:      clientEntry.DenyLogin,
+		})
+	} else {
+		// Pattern mappings only apply to clients without an exact mapping
+		// that is still in effect
+		patternName, pattern, err := b.matchClientPattern(ctx, req.Storage, client)
+		if err != nil {
+			return nil, err
+		}
+		if pattern != nil {
+			mappings = append(mappings, &policyMapping{
+				Kind:           "client_pattern",
+				Name:           patternName,
+				Policies:       pattern.Policies,
+				DeniedPolicies: pattern.DeniedPolicies,
+				DenyLogin:      pattern.DenyLogin,
+			})
+		}
+	}
+
+	// Clients of a named Chef server get that server's default policies, and
+	// environment and Chef role mappings only apply within the client's server
+	// and organization
+	server, org, _ := splitClient(client)
+	config, err := b.serverConfig(ctx, req.Storage, server)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.DefaultPolicies) > 0 {
+		source := "config"
+		if server != "" {
+			source = "server/" + server
+		}
+		mappings = append(mappings, &policyMapping{
+			Kind:     "default",
+			Name:     source,
+			Policies: config.DefaultPolicies,
+		})
+	}
+
+	// Only fetch the node when there are environment mappings to match against
+	envs, err := req.Storage.List(ctx, "environment/")
+	if err != nil {
+		return nil, err
+	}
+	if len(envs) > 0 {
+		n, err := node.get()
+		if err != nil {
+			return nil, err
+		}
+		envName := qualifyClient(server, org, n.Environment)
+		envEntry, err := b.Environment(ctx, req.Storage, envName)
+		if err != nil {
+			return nil, err
+		}
+		if envEntry != nil {
+			mappings = append(mappings, &policyMapping{
+				Kind:           "environment",
+				Name:           envName,
+				Policies:       envEntry.Policies,
+				DeniedPolicies: envEntry.DeniedPolicies,
+				DenyLogin:      envEntry.DenyLogin,
+			})
+		}
+	}
+
+	// Chef role mappings are matched against the fully expanded role list
+	chefRoles, err := req.Storage.List(ctx, "chef_role/")
+	if err != nil {
+		return nil, err
+	}
+	if len(chefRoles) > 0 {
+		roles, err := node.roles()
+		if err != nil {
+			return nil, err
+		}
+		roles = strutil.RemoveDuplicates(roles, false)
+		for _, r := range roles {
+			roleName := qualifyClient(server, org, r)
+			roleEntry, err := b.ChefRole(ctx, req.Storage, roleName)
+			if err != nil {
+				return nil, err
+			}
+			if roleEntry == nil {
+				continue
+			}
+			mappings = append(mappings, &policyMapping{
+				Kind:           "chef_role",
+				Name:           roleName,
+				Policies:       roleEntry.Policies,
+				DeniedPolicies: roleEntry.DeniedPolicies,
+				DenyLogin:      roleEntry.DenyLogin,
+			})
+		}
+	}
+
+	return mappings, nil
+}
+
+// policyEvaluation records how a node's final policy set was computed.
+type policyEvaluation struct {
+	// Policies is the final policy set
+	Policies []string
+	// Sources maps each final policy to the mappings that granted it
+	Sources map[string][]string
+	// Denied maps each granted but denied policy to the mappings that denied it
+	Denied map[string][]string
+	// Filtered lists granted policies removed by the mount-wide policy limits
+	Filtered []string
+	// LoginDenied lists the mappings that block login entirely
+	LoginDenied []*policyMapping
+	// Unrendered lists templated denied policies that couldn't be rendered,
+	// which also block login
+	Unrendered []*unrenderedDenialError
+}
+
+type sourcedPolicy struct {
+	policy string
+	source string
+}
+
+// evaluatePolicies computes the final policy set from base and the mappings.
+// Policies granted by the mappings are only added when grant is set, but denied
+// policies and login denials from every mapping always apply. The result is
+// limited to the policies permitted by the mount configuration.
+func evaluatePolicies(conf *config, base *policyMapping, mappings []*policyMapping, grant bool, node *nodeLoader) (*policyEvaluation, error) {
+	eval := &policyEvaluation{
+		Sources: make(map[string][]string),
+		Denied:  make(map[string][]string),
+	}
+
+	var granted, denied []sourcedPolicy
+	if base != nil {
+		for _, p := range base.Policies {
+			granted = append(granted, sourcedPolicy{p, base.source()})
+		}
+	}
+	for _, m := range mappings {
+		if m.DenyLogin {
+			eval.LoginDenied = append(eval.LoginDenied, m)
+		}
+		if grant {
+			for _, p := range m.Policies {
+				granted = append(granted, sourcedPolicy{p, m.source()})
+			}
+		}
+		for _, p := range m.DeniedPolicies {
+			denied = append(denied, sourcedPolicy{p, m.source()})
+		}
+	}
+
+	var err error
+	if granted, err = renderSourcedPolicies(granted, node); err != nil {
+		return nil, err
+	}
+	if denied, err = renderDeniedPolicies(eval, denied, node); err != nil {
+		return nil, err
+	}
+
+	deniedBy := make(map[string][]string)
+	for _, d := range denied {
+		deniedBy[d.policy] = strutil.AppendIfMissing(deniedBy[d.policy], d.source)
+	}
+	for _, g := range granted {
+		switch {
+		case len(deniedBy[g.policy]) > 0:
+			eval.Denied[g.policy] = deniedBy[g.policy]
+		case !conf.permitsPolicy(g.policy):
+			eval.Filtered = strutil.AppendIfMissing(eval.Filtered, g.policy)
+		default:
+			eval.Sources[g.policy] = strutil.AppendIfMissing(eval.Sources[g.policy], g.source)
+		}
+	}
+
+	for p := range eval.Sources {
+		eval.Policies = append(eval.Policies, p)
+	}
+	sort.Strings(eval.Policies)
+	return eval, nil
+}
+
+// renderSourcedPolicies renders templated policy names against the node,
+// dropping any that can't be rendered. The node is only fetched if needed.
+func renderSourcedPolicies(policies []sourcedPolicy, node *nodeLoader) ([]sourcedPolicy, error) {
+	var ret []sourcedPolicy
+	for _, sp := range policies {
+		if !isTemplate(sp.policy) {
+			ret = append(ret, sp)
+			continue
+		}
+		n, err := node.get()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range renderPolicies([]string{sp.policy}, n) {
+			ret = append(ret, sourcedPolicy{p, sp.source})
+		}
+	}
+	return ret, nil
+}
+
+// renderDeniedPolicies is renderSourcedPolicies for denied policies. A denial
+// that can't be rendered isn't dropped but recorded in eval.Unrendered.
+func renderDeniedPolicies(eval *policyEvaluation, policies []sourcedPolicy, node *nodeLoader) ([]sourcedPolicy, error) {
+	var ret []sourcedPolicy
+	for _, sp := range policies {
+		if !isTemplate(sp.policy) {
+			ret = append(ret, sp)
+			continue
+		}
+		n, err := node.get()
+		if err != nil {
+			return nil, err
+		}
+		p, ok := renderPolicy(sp.policy, n)
+		if !ok {
+			eval.Unrendered = append(eval.Unrendered, &unrenderedDenialError{source: sp.source, policy: sp.policy})
+			continue
+		}
+		ret = append(ret, sourcedPolicy{p, sp.source})
+	}
+	return ret, nil
+}
+
+// loginRefused reports whether the evaluation blocks login.
+func (e *policyEvaluation) loginRefused() bool {
+	return len(e.LoginDenied) > 0 || len(e.Unrendered) > 0
+}
+
+// resolvePolicies returns the final policy set computed by evaluatePolicies,
+// or a loginDeniedError or unrenderedDenialError if login is blocked.
+func resolvePolicies(conf *config, base *policyMapping, mappings []*policyMapping, grant bool, node *nodeLoader) ([]string, error) {
+	eval, err := evaluatePolicies(conf, base, mappings, grant, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(eval.LoginDenied) > 0 {
+		return nil, &loginDeniedError{mapping: eval.LoginDenied[0]}
+	}
+	if len(eval.Unrendered) > 0 {
+		return nil, eval.Unrendered[0]
+	}
+	return eval.Policies, nil
+}
+
+func (b *backend) getNodePolicies(ctx context.Context, req *logical.Request, node string) ([]string, error) {
+	return b.nodePolicies(ctx, req, node, b.nodeLoader(ctx, req, node))
+}
+
+// nodePolicies is getNodePolicies with a node loader that may already have
+// fetched the node.
+func (b *backend) nodePolicies(ctx context.Context, req *logical.Request, node string, loader *nodeLoader) ([]string, error) {
+	mappings, err := b.nodeMappings(ctx, req, node, loader)
+	if err != nil {
+		return nil, err
+	}
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return resolvePolicies(config, nil, mappings, true, loader)
+}
@@ -0,0 +1,233 @@
+package chefnode
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// seenClientEntry records a Chef client that has successfully logged in.
+type seenClientEntry struct {
+	LastLogin time.Time `json:"last_login"`
+}
+
+// recordLogin remembers that the client has logged in, so that mapping changes
+// can be previewed against it.
+func (b *backend) recordLogin(ctx context.Context, s logical.Storage, client string) error {
+	entry, err := logical.StorageEntryJSON("seen/"+client, &seenClientEntry{
+		LastLogin: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+var previewSchema = &framework.FieldSchema{
+	Type: framework.TypeBool,
+	Description: `If set, nothing is saved. Instead the response lists how the policies
+of every client that has logged in would change if the write was applied. Nodes are
+fetched from the Chef server up to 8 at a time.`,
+}
+
+// previewable wraps a mapping write callback so that it can be called with
+// preview set. In that case the write is applied to an in memory overlay of the
+// backend storage and the resulting policy changes are returned.
+func (b *backend) previewable(op framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		if !d.Get("preview").(bool) {
+			return op(ctx, req, d)
+		}
+
+		overlay := newOverlayStorage(req.Storage)
+		previewReq := *req
+		previewReq.Storage = overlay
+		resp, err := op(ctx, &previewReq, d)
+		if err != nil || (resp != nil && resp.IsError()) {
+			return resp, err
+		}
+
+		return b.previewChanges(ctx, req, &previewReq)
+	}
+}
+
+// previewConcurrency is the number of clients whose nodes are fetched and
+// evaluated at the same time by a preview.
+const previewConcurrency = 8
+
+// isPreview reports whether the request is a preview, whose writes go to an
+// overlay storage. Callbacks use it to skip side effects outside of storage.
+func isPreview(req *logical.Request) bool {
+	_, ok := req.Storage.(*overlayStorage)
+	return ok
+}
+
+// previewChanges evaluates every client that has logged in against the
+// storage of both requests and returns the difference in their policies.
+// Clients are evaluated previewConcurrency at a time, since each of them may
+// require fetching its node from the Chef server.
+func (b *backend) previewChanges(ctx context.Context, before *logical.Request, after *logical.Request) (*logical.Response, error) {
+	clients, err := listClients(ctx, before.Storage, "seen/")
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, previewConcurrency)
+	changes := make(map[string]interface{})
+	errors := make(map[string]string)
+	for _, client := range clients {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(client string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			change, err := b.previewClient(ctx, before, after, client)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errors[client] = err.Error()
+			} else if change != nil {
+				changes[client] = change
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"evaluated_clients": len(clients),
+			"changes":           changes,
+			"errors":            errors,
+		},
+	}, nil
+}
+
+// previewClient returns how the client's policies differ between the storage
+// of both requests, or nil if they don't.
+func (b *backend) previewClient(ctx context.Context, before *logical.Request, after *logical.Request, client string) (map[string]interface{}, error) {
+	loader := b.nodeLoader(ctx, before, client)
+	oldPols, oldDenied, err := b.previewPolicies(ctx, before, client, loader)
+	if err != nil {
+		return nil, err
+	}
+	newPols, newDenied, err := b.previewPolicies(ctx, after, client, loader)
+	if err != nil {
+		return nil, err
+	}
+
+	added := policyDifference(newPols, oldPols)
+	removed := policyDifference(oldPols, newPols)
+	if len(added) == 0 && len(removed) == 0 && oldDenied == newDenied {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"added_policies":   added,
+		"removed_policies": removed,
+		"login_denied":     newDenied,
+	}, nil
+}
+
+// previewPolicies returns the client's policies and whether its login would be
+// denied by a mapping.
+func (b *backend) previewPolicies(ctx context.Context, req *logical.Request, client string, loader *nodeLoader) ([]string, bool, error) {
+	config, err := b.Config(ctx, req.Storage)
+	if err != nil {
+		return nil, false, err
+	}
+	mappings, err := b.nodeMappings(ctx, req, client, loader)
+	if err != nil {
+		return nil, false, err
+	}
+	eval, err := evaluatePolicies(config, nil, mappings, true, loader)
+	if err != nil {
+		return nil, false, err
+	}
+	return eval.Policies, eval.loginRefused(), nil
+}
+
+// policyDifference returns the policies in a that aren't in b.
+func policyDifference(a, b []string) []string {
+	ret := []string{}
+	for _, p := range a {
+		if !strutil.StrListContains(b, p) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// overlayStorage records writes and deletes in memory on top of another
+// storage, which is never modified.
+type overlayStorage struct {
+	logical.Storage
+
+	puts    map[string]*logical.StorageEntry
+	deletes map[string]bool
+}
+
+func newOverlayStorage(s logical.Storage) *overlayStorage {
+	return &overlayStorage{
+		Storage: s,
+		puts:    make(map[string]*logical.StorageEntry),
+		deletes: make(map[string]bool),
+	}
+}
+
+func (o *overlayStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if o.deletes[key] {
+		return nil, nil
+	}
+	if entry, ok := o.puts[key]; ok {
+		return entry, nil
+	}
+	return o.Storage.Get(ctx, key)
+}
+
+func (o *overlayStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	delete(o.deletes, entry.Key)
+	o.puts[entry.Key] = entry
+	return nil
+}
+
+func (o *overlayStorage) Delete(ctx context.Context, key string) error {
+	delete(o.puts, key)
+	o.deletes[key] = true
+	return nil
+}
+
+func (o *overlayStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := o.Storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, k := range keys {
+		if !o.deletes[prefix+k] {
+			ret = append(ret, k)
+		}
+	}
+	for key := range o.puts {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		k := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(k, "/"); i >= 0 {
+			k = k[:i+1]
+		}
+		ret = strutil.AppendIfMissing(ret, k)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}